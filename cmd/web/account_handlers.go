@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+)
+
+func (app *application) accountView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	privacy, err := app.policy.GetPrivacy(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	blocked, err := app.policy.BlockedUsers(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.Blocked = blocked
+	data.TwoFactor, err = app.twoFactor.Enabled(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	data.Identities, err = app.identities.Identities(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	data.Form = PrivacyForm{AcceptMessages: privacy.AcceptMessages}
+	app.render(w, http.StatusOK, "account.html", data)
+}
+
+func (app *application) accountPrivacyPost(w http.ResponseWriter, r *http.Request) {
+	var form PrivacyForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(form.AcceptMessages == models.AcceptFriends || form.AcceptMessages == models.AcceptAnyone,
+		"acceptMessages", "Choose who can message you.")
+
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	if !form.Valid() {
+		user, err := app.users.Get(userId)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		blocked, err := app.policy.BlockedUsers(userId)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		data := app.newTemplateData(r)
+		data.User = user
+		data.Blocked = blocked
+		data.TwoFactor, err = app.twoFactor.Enabled(userId)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		data.Identities, err = app.identities.Identities(userId)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "account.html", data)
+		return
+	}
+
+	err = app.policy.SetPrivacy(userId, models.Privacy{AcceptMessages: form.AcceptMessages})
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
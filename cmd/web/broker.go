@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// topic prefixes, a direct conversation is keyed by both user ids sorted so
+// either participant publishes to the same topic
+const (
+	topicDirect  = "dm"
+	topicGroup   = "group"
+	topicUser    = "user"
+	topicSession = "session"
+	topicMember  = "member"
+	topicBlock   = "block"
+)
+
+func directTopic(id1, id2 string) string {
+	ids := []string{id1, id2}
+	slices.Sort(ids)
+	return topicDirect + ":" + ids[0] + ":" + ids[1]
+}
+
+func groupTopic(groupId string) string {
+	return topicGroup + ":" + groupId
+}
+
+func userTopic(userId string) string {
+	return topicUser + ":" + userId
+}
+
+// blockTopic reaches the direct conversation of two users to close it when
+// one blocks the other.
+func blockTopic(id1, id2 string) string {
+	ids := []string{id1, id2}
+	slices.Sort(ids)
+	return topicBlock + ":" + ids[0] + ":" + ids[1]
+}
+
+// memberTopic reaches the group connections of one member, to close them when
+// they are removed.
+func memberTopic(groupId, userId string) string {
+	return topicMember + ":" + groupId + ":" + userId
+}
+
+func sessionTopic(sessionId string) string {
+	return topicSession + ":" + sessionId
+}
+
+// brokerMessage is what travels through the broker: an event for every local
+// subscriber of the topic, except the connections of the user Except.
+type brokerMessage struct {
+	Topic  string `json:"topic"`
+	Except string `json:"except,omitempty"`
+	Event  event  `json:"event"`
+}
+
+// broker fans events out to every instance of the server, the one publishing
+// included. Each instance hands what it receives to its own subscribers.
+type broker interface {
+	publish(msg brokerMessage) error
+	close() error
+}
+
+// memoryBroker delivers straight to the subscribers of this instance, for
+// running a single instance.
+type memoryBroker struct {
+	deliver func(msg brokerMessage)
+}
+
+func (b *memoryBroker) publish(msg brokerMessage) error {
+	b.deliver(msg)
+	return nil
+}
+
+func (b *memoryBroker) close() error {
+	return nil
+}
+
+const (
+	// brokerChannel is the postgres channel every instance listens on.
+	brokerChannel = "message_events"
+	// maxNotifyPayload keeps notifications under the 8000 byte payload limit
+	// of postgres, larger messages are stored in broker_events and only
+	// their id is sent.
+	maxNotifyPayload = 7900
+	// brokerEventTTL is how long stored messages are kept around.
+	brokerEventTTL = time.Minute
+)
+
+var errBrokerClosed = errors.New("broker closed")
+
+// pgBroker fans events out through postgres LISTEN/NOTIFY so every instance
+// connected to the same database delivers them. Notifications sent while an
+// instance is reconnecting are lost, like events sent to a client that is
+// reconnecting.
+type pgBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+	deliver  func(msg brokerMessage)
+	errorLog *log.Logger
+	done     chan struct{}
+}
+
+func newPgBroker(db *sql.DB, dsn string, deliver func(msg brokerMessage), errorLog *log.Logger) (*pgBroker, error) {
+	b := &pgBroker{
+		db:       db,
+		deliver:  deliver,
+		errorLog: errorLog,
+		done:     make(chan struct{}),
+	}
+	b.listener = pq.NewListener(dsn, 100*time.Millisecond, 10*time.Second, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			errorLog.Printf("Broker listener: %s", err)
+		}
+	})
+	err := b.listener.Listen(brokerChannel)
+	if err != nil {
+		b.listener.Close()
+		return nil, err
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *pgBroker) publish(msg brokerMessage) error {
+	select {
+	case <-b.done:
+		return errBrokerClosed
+	default:
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	notification := string(payload)
+	if len(payload) > maxNotifyPayload {
+		var id int64
+		now := time.Now().UTC()
+		stmt := "INSERT INTO broker_events (payload, created) VALUES ($1, $2) RETURNING id"
+		err = b.db.QueryRow(stmt, notification, now).Scan(&id)
+		if err != nil {
+			return err
+		}
+		_, err = b.db.Exec("DELETE FROM broker_events WHERE created < $1", now.Add(-brokerEventTTL))
+		if err != nil {
+			b.errorLog.Println(err)
+		}
+		notification = "#" + strconv.FormatInt(id, 10)
+	}
+
+	_, err = b.db.Exec("SELECT pg_notify($1, $2)", brokerChannel, notification)
+	return err
+}
+
+// run delivers notifications until the broker is closed.
+func (b *pgBroker) run() {
+	for {
+		select {
+		case <-b.done:
+			return
+		case n := <-b.listener.Notify:
+			// nil after the listener reconnected
+			if n == nil {
+				continue
+			}
+			msg, err := b.decode(n.Extra)
+			if err != nil {
+				b.errorLog.Printf("Broker: %s", err)
+				continue
+			}
+			b.deliver(msg)
+		case <-time.After(90 * time.Second):
+			// notice a dead connection even if nobody publishes
+			go b.listener.Ping()
+		}
+	}
+}
+
+func (b *pgBroker) decode(notification string) (brokerMessage, error) {
+	payload := notification
+	if id, ok := strings.CutPrefix(notification, "#"); ok {
+		err := b.db.QueryRow("SELECT payload FROM broker_events WHERE id = $1", id).Scan(&payload)
+		if err != nil {
+			return brokerMessage{}, fmt.Errorf("stored event %s: %w", id, err)
+		}
+	}
+
+	// the payload is kept as raw json, it is only written out again
+	var wire struct {
+		Topic  string `json:"topic"`
+		Except string `json:"except"`
+		Event  struct {
+			Type    string          `json:"type"`
+			Version int             `json:"version"`
+			ID      string          `json:"id"`
+			Payload json.RawMessage `json:"payload"`
+		} `json:"event"`
+	}
+	err := json.Unmarshal([]byte(payload), &wire)
+	if err != nil {
+		return brokerMessage{}, err
+	}
+	return brokerMessage{
+		Topic:  wire.Topic,
+		Except: wire.Except,
+		Event: event{
+			Type:    wire.Event.Type,
+			Version: wire.Event.Version,
+			ID:      wire.Event.ID,
+			Payload: wire.Event.Payload,
+		},
+	}, nil
+}
+
+func (b *pgBroker) close() error {
+	close(b.done)
+	return b.listener.Close()
+}
+
+// publish hands an event for the subscribers of topic to the broker.
+func (app *application) publish(topic, except string, ev event) {
+	err := app.broker.publish(brokerMessage{Topic: topic, Except: except, Event: ev})
+	if err != nil {
+		app.errorLog.Printf("Publishing to %s: %s", topic, err)
+	}
+}
+
+// deliver passes a message from the broker on to the subscribers connected to
+// this instance.
+func (app *application) deliver(msg brokerMessage) {
+	kind, id, _ := strings.Cut(msg.Topic, ":")
+	switch kind {
+	case topicDirect:
+		id1, id2, _ := strings.Cut(id, ":")
+		room, ok := app.directMessageServer.getRoomByIds(id1, id2)
+		if ok {
+			room.deliver(msg.Event, msg.Except)
+		}
+	case topicGroup:
+		group, ok := app.groupMessageServer.lookupGroup(id)
+		if ok {
+			group.deliver(msg.Event, msg.Except)
+		}
+	case topicUser:
+		app.presence.sendTo(id, msg.Event)
+	case topicBlock:
+		id1, id2, _ := strings.Cut(id, ":")
+		room, ok := app.directMessageServer.getRoomByIds(id1, id2)
+		if ok {
+			room.closeAll(statusNotAllowed, "conversation blocked")
+		}
+	case topicMember:
+		groupId, userId, _ := strings.Cut(id, ":")
+		group, ok := app.groupMessageServer.lookupGroup(groupId)
+		if ok {
+			group.closeUser(userId, statusNotAMember, "removed from the group")
+		}
+	case topicSession:
+		app.presence.closeSession(id, statusSessionRevoked, "session logged out")
+	default:
+		app.errorLog.Printf("Broker: unknown topic %q", msg.Topic)
+	}
+}
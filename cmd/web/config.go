@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the upper cased flag name to get the environment
+// variable of a setting, -session-lifetime is read from MESSAGE_SESSION_LIFETIME.
+const envPrefix = "MESSAGE_"
+
+// config holds every setting that differs between deployments. Settings are
+// read from, in increasing order of precedence, the defaults, the config file,
+// the environment and the command line flags.
+type config struct {
+	addr            string
+	dsn             string
+	sessionLifetime time.Duration
+	secureCookies   bool
+	uploadDir       string
+	shutdownTimeout time.Duration
+	tlsCert         string
+	tlsKey          string
+	redirectAddr    string
+	broker          string
+	baseURL         string
+	secretKey       string
+	mail            struct {
+		transport    string
+		from         string
+		dir          string
+		smtpHost     string
+		smtpPort     int
+		smtpUsername string
+		smtpPassword string
+	}
+	oidc struct {
+		issuer         string
+		clientID       string
+		clientSecret   string
+		allowedIssuers string
+		createUsers    bool
+	}
+	limits struct {
+		userBurst            int
+		userInterval         time.Duration
+		conversationBurst    int
+		conversationInterval time.Duration
+	}
+}
+
+// secretSettings are redacted by -print-config.
+var secretSettings = map[string]bool{
+	"dsn":                true,
+	"smtp-password":      true,
+	"secret-key":         true,
+	"oidc-client-secret": true,
+}
+
+func defaultConfig() config {
+	cfg := config{
+		addr:            ":4000",
+		dsn:             "postgres://postgres@localhost:5432/message?sslmode=disable",
+		sessionLifetime: 12 * time.Hour,
+		secureCookies:   false,
+		uploadDir:       "./ui/static/images",
+		shutdownTimeout: 30 * time.Second,
+		broker:          "memory",
+		baseURL:         "http://localhost:4000",
+	}
+	cfg.mail.transport = "file"
+	cfg.mail.from = "Message <no-reply@localhost>"
+	cfg.mail.smtpPort = 587
+	cfg.limits.userBurst = 10
+	cfg.limits.userInterval = time.Second
+	cfg.limits.conversationBurst = 30
+	cfg.limits.conversationInterval = 200 * time.Millisecond
+	return cfg
+}
+
+// flags registers a flag for every setting of the config.
+func (cfg *config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.addr, "addr", cfg.addr, "HTTP network address")
+	fs.StringVar(&cfg.dsn, "dsn", cfg.dsn, "PostgreSQL data source name, without a password it comes from PGPASSWORD or ~/.pgpass")
+	fs.DurationVar(&cfg.sessionLifetime, "session-lifetime", cfg.sessionLifetime, "how long a login lasts")
+	fs.BoolVar(&cfg.secureCookies, "secure-cookies", cfg.secureCookies, "only send the session cookie over https")
+	fs.StringVar(&cfg.uploadDir, "upload-dir", cfg.uploadDir, "directory uploaded avatars are stored in")
+	fs.StringVar(&cfg.tlsCert, "tls-cert", cfg.tlsCert, "PEM certificate file, serves HTTPS when set together with -tls-key")
+	fs.StringVar(&cfg.tlsKey, "tls-key", cfg.tlsKey, "PEM private key file of the certificate")
+	fs.StringVar(&cfg.redirectAddr, "redirect-addr", cfg.redirectAddr, "optional HTTP address redirecting to HTTPS, like :80")
+	fs.StringVar(&cfg.broker, "broker", cfg.broker, "how events reach subscribers: memory for a single instance, postgres to fan out to every instance")
+	fs.IntVar(&cfg.limits.userBurst, "limit-user-burst", cfg.limits.userBurst, "messages a user can send at once")
+	fs.DurationVar(&cfg.limits.userInterval, "limit-user-interval", cfg.limits.userInterval, "time for a user to earn another message")
+	fs.IntVar(&cfg.limits.conversationBurst, "limit-conversation-burst", cfg.limits.conversationBurst, "messages a conversation can take at once")
+	fs.DurationVar(&cfg.limits.conversationInterval, "limit-conversation-interval", cfg.limits.conversationInterval, "time for a conversation to take another message")
+	fs.StringVar(&cfg.baseURL, "base-url", cfg.baseURL, "url the site is reached at, used for links in emails")
+	fs.StringVar(&cfg.secretKey, "secret-key", cfg.secretKey, "key signing the links in emails, random on every start when empty")
+	fs.StringVar(&cfg.mail.transport, "mailer", cfg.mail.transport, "how emails are sent: smtp, or file to write them to -mail-dir or the log")
+	fs.StringVar(&cfg.mail.from, "mail-from", cfg.mail.from, "sender address of emails")
+	fs.StringVar(&cfg.mail.dir, "mail-dir", cfg.mail.dir, "directory the file mailer writes emails to, they are logged when empty")
+	fs.StringVar(&cfg.mail.smtpHost, "smtp-host", cfg.mail.smtpHost, "SMTP server host")
+	fs.IntVar(&cfg.mail.smtpPort, "smtp-port", cfg.mail.smtpPort, "SMTP server port")
+	fs.StringVar(&cfg.mail.smtpUsername, "smtp-username", cfg.mail.smtpUsername, "SMTP username, no authentication when empty")
+	fs.StringVar(&cfg.mail.smtpPassword, "smtp-password", cfg.mail.smtpPassword, "SMTP password")
+	fs.StringVar(&cfg.oidc.issuer, "oidc-issuer", cfg.oidc.issuer, "OpenID Connect provider url to log in with, single sign-on is off when empty")
+	fs.StringVar(&cfg.oidc.clientID, "oidc-client-id", cfg.oidc.clientID, "client id registered with the OpenID Connect provider, with the -base-url path /user/sso/callback as redirect url")
+	fs.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", cfg.oidc.clientSecret, "client secret registered with the OpenID Connect provider")
+	fs.StringVar(&cfg.oidc.allowedIssuers, "oidc-allowed-issuers", cfg.oidc.allowedIssuers, "comma separated issuers whose tokens are accepted, only -oidc-issuer when empty")
+	fs.BoolVar(&cfg.oidc.createUsers, "oidc-create-users", cfg.oidc.createUsers, "create an account on the first single sign-on of someone without one")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", cfg.shutdownTimeout, "how long to wait for open requests and connections on shutdown")
+}
+
+func (cfg *config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(cfg.addr); err != nil {
+		errs = append(errs, fmt.Errorf("addr: %w", err))
+	}
+	if u, err := url.Parse(cfg.dsn); err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		errs = append(errs, errors.New("dsn: must be a postgres:// url"))
+	}
+	if cfg.sessionLifetime <= 0 {
+		errs = append(errs, errors.New("session-lifetime: must be positive"))
+	}
+	if cfg.shutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown-timeout: must be positive"))
+	}
+	if cfg.broker != "memory" && cfg.broker != "postgres" {
+		errs = append(errs, fmt.Errorf("broker: unknown broker %q", cfg.broker))
+	}
+	if cfg.limits.userBurst < 1 || cfg.limits.userInterval <= 0 {
+		errs = append(errs, errors.New("limit-user-burst and limit-user-interval: must be positive"))
+	}
+	if cfg.limits.conversationBurst < 1 || cfg.limits.conversationInterval <= 0 {
+		errs = append(errs, errors.New("limit-conversation-burst and limit-conversation-interval: must be positive"))
+	}
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key: must be set together"))
+	}
+	if cfg.redirectAddr != "" {
+		if !cfg.tlsEnabled() {
+			errs = append(errs, errors.New("redirect-addr: requires tls-cert and tls-key"))
+		} else if _, _, err := net.SplitHostPort(cfg.redirectAddr); err != nil {
+			errs = append(errs, fmt.Errorf("redirect-addr: %w", err))
+		}
+	}
+	if u, err := url.Parse(cfg.baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, errors.New("base-url: must be an http:// or https:// url"))
+	}
+	if cfg.secretKey != "" && len(cfg.secretKey) < 32 {
+		errs = append(errs, errors.New("secret-key: must be at least 32 characters"))
+	}
+	if _, err := mail.ParseAddress(cfg.mail.from); err != nil {
+		errs = append(errs, fmt.Errorf("mail-from: %w", err))
+	}
+	switch cfg.mail.transport {
+	case "file":
+		if cfg.mail.dir != "" {
+			if info, err := os.Stat(cfg.mail.dir); err != nil || !info.IsDir() {
+				errs = append(errs, fmt.Errorf("mail-dir: %q is not a directory", cfg.mail.dir))
+			}
+		}
+	case "smtp":
+		if cfg.mail.smtpHost == "" {
+			errs = append(errs, errors.New("smtp-host: required by the smtp mailer"))
+		}
+		if cfg.mail.smtpPort < 1 || cfg.mail.smtpPort > 65535 {
+			errs = append(errs, errors.New("smtp-port: must be a port number"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("mailer: unknown mailer %q", cfg.mail.transport))
+	}
+	if cfg.oidc.issuer != "" {
+		// plain http is only good enough for a provider on this machine
+		u, err := url.Parse(cfg.oidc.issuer)
+		local := err == nil && (u.Hostname() == "localhost" || net.ParseIP(u.Hostname()).IsLoopback())
+		if err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && local)) {
+			errs = append(errs, errors.New("oidc-issuer: must be an https:// url, or http:// on localhost"))
+		}
+		if cfg.oidc.clientID == "" {
+			errs = append(errs, errors.New("oidc-client-id: required by oidc-issuer"))
+		}
+	} else if cfg.oidc.allowedIssuers != "" || cfg.oidc.clientID != "" {
+		errs = append(errs, errors.New("oidc-allowed-issuers and oidc-client-id: require oidc-issuer"))
+	}
+	return errors.Join(errs...)
+}
+
+// validateServe checks the settings only the server needs, which the migrate
+// subcommand and -print-config can do without.
+func (cfg *config) validateServe() error {
+	if info, err := os.Stat(cfg.uploadDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("upload-dir: %q is not a directory", cfg.uploadDir)
+	}
+	return nil
+}
+
+func (cfg *config) tlsEnabled() bool {
+	return cfg.tlsCert != "" && cfg.tlsKey != ""
+}
+
+// oidcIssuers returns the issuers whose ID tokens are accepted.
+func (cfg *config) oidcIssuers() []string {
+	if cfg.oidc.allowedIssuers == "" {
+		return []string{cfg.oidc.issuer}
+	}
+	var issuers []string
+	for _, issuer := range strings.Split(cfg.oidc.allowedIssuers, ",") {
+		if issuer = strings.TrimSpace(issuer); issuer != "" {
+			issuers = append(issuers, issuer)
+		}
+	}
+	return issuers
+}
+
+// loadConfig builds the config from the command line arguments, the
+// environment and the config file named by -config or MESSAGE_CONFIG. It also
+// returns the arguments left after the flags, like the migrate subcommand.
+func loadConfig(args []string, getenv func(string) string) (*config, bool, []string, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("app", flag.ContinueOnError)
+	cfg.flags(fs)
+
+	var configFile string
+	var printConfig bool
+	fs.StringVar(&configFile, "config", getenv(envPrefix+"CONFIG"), "path of a YAML config file")
+	fs.BoolVar(&printConfig, "print-config", false, "print the resolved config with secrets redacted and exit")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	// remember what was given on the command line and start over so the file
+	// and the environment can't override it
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	cfg = defaultConfig()
+
+	if configFile != "" {
+		err = cfg.readFile(fs, configFile)
+		if err != nil {
+			return nil, false, nil, err
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value := getenv(name); value != "" {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	for name, value := range explicit {
+		err = fs.Set(name, value)
+		if err != nil {
+			return nil, false, nil, err
+		}
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, false, nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return &cfg, printConfig, fs.Args(), nil
+}
+
+// readFile applies a flat YAML file of flag names to values, for example
+//
+//	addr: ":8080"
+//	session-lifetime: 24h
+func (cfg *config) readFile(fs *flag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]any
+	err = yaml.Unmarshal(b, &values)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for name, value := range values {
+		if name == "config" || name == "print-config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		err = fs.Set(name, fmt.Sprint(value))
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// print writes the config in the config file format with the secrets
+// redacted, so the output can be used as a starting point for a config file.
+func (cfg *config) print(w io.Writer) error {
+	fs := flag.NewFlagSet("app", flag.ContinueOnError)
+	cfg.flags(fs)
+
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = redact(f.Name, f.Value.String())
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		_, err := fmt.Fprintf(w, "%s: %q\n", name, values[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redact hides the value of a secret setting. For urls with a user only the
+// passwords, in the user info or the query, are hidden so the rest is still
+// useful when debugging. Anything else, like a key/value DSN, is hidden
+// entirely.
+func redact(name, value string) string {
+	if !secretSettings[name] || value == "" {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.User == nil {
+		return "REDACTED"
+	}
+	query := u.Query()
+	for _, key := range []string{"password", "sslpassword"} {
+		if query.Has(key) {
+			query.Set(key, "xxxxx")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.Redacted()
+}
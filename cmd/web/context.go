@@ -2,5 +2,7 @@ package main
 
 type contextKey string
 
-const isAuthenticatedContextKey = contextKey("isAuthenticated")
-const userIdKey = contextKey("authUserID")
+const (
+	isAuthenticatedContextKey = contextKey("isAuthenticated")
+	isVerifiedContextKey      = contextKey("isVerified")
+)
@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -14,22 +14,39 @@ import (
 	"nhooyr.io/websocket"
 )
 
+// messageBuffer is the number of events queued for a subscriber before it is
+// considered too slow and disconnected.
+const messageBuffer = 16
+
+// statusNotAllowed closes the connections to a direct conversation the users
+// can't have anymore, like after a block. Clients stop reconnecting to it.
+const statusNotAllowed websocket.StatusCode = 4002
+
 type directMsgServer struct {
 	room map[string]*dmRoom
 	mu   sync.Mutex
 }
 
 type dmRoom struct {
-	messageBuffer int
-	mu            sync.Mutex
-	activeConns   map[*msgSubscriber]struct{}
+	mu          sync.Mutex
+	activeConns map[*msgSubscriber]struct{}
+	lastTyping  map[string]time.Time
 }
 
 type msgSubscriber struct {
-	msgs      chan models.DirectMessage
-	closeSlow func()
+	userId    string
+	sessionId string // the login the connection belongs to
+	name      string
+	msgs      chan event
+	mu        sync.Mutex
+	c         *websocket.Conn
+	closed    bool
 }
 
+// frameHandler is called for every frame a subscriber sends over its
+// connection. A returned error is sent back to that subscriber only.
+type frameHandler func(ctx context.Context, sub *msgSubscriber, f clientFrame) error
+
 func serverDM() *directMsgServer {
 	return &directMsgServer{
 		room: make(map[string]*dmRoom),
@@ -38,8 +55,17 @@ func serverDM() *directMsgServer {
 
 func newDMRoom() *dmRoom {
 	return &dmRoom{
-		messageBuffer: 16,
-		activeConns:   make(map[*msgSubscriber]struct{}),
+		activeConns: make(map[*msgSubscriber]struct{}),
+		lastTyping:  make(map[string]time.Time),
+	}
+}
+
+func newSubscriber(userId, sessionId, name string) *msgSubscriber {
+	return &msgSubscriber{
+		userId:    userId,
+		sessionId: sessionId,
+		name:      name,
+		msgs:      make(chan event, messageBuffer),
 	}
 }
 
@@ -61,74 +87,27 @@ func (s *directMsgServer) getRoomByIds(id1, id2 string) (*dmRoom, bool) {
 	return nil, false
 }
 
-func (s *directMsgServer) subscribe(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	senderId, ok := r.Context().Value(userIdKey).(string)
-	if !ok || senderId == "" {
-		return errors.New("Invalid sender id")
-	}
-	//TODO: validate id
+func (s *directMsgServer) subscribe(ctx context.Context, w http.ResponseWriter, r *http.Request, sub *msgSubscriber, handle frameHandler) error {
 	params := httprouter.ParamsFromContext(r.Context())
 	receiverId := params.ByName("id")
 	if receiverId == "" {
 		return models.ErrNotFound
 	}
-	room, ok := s.getRoomByIds(senderId, receiverId)
+	room, ok := s.getRoomByIds(sub.userId, receiverId)
 	if !ok {
-		key := fmt.Sprintf("%s:%s", senderId, receiverId)
+		key := fmt.Sprintf("%s:%s", sub.userId, receiverId)
 		s.mu.Lock()
 		s.room[key] = newDMRoom()
 		room = s.room[key]
 		s.mu.Unlock()
 	}
-	return room.subscribe(ctx, w, r)
-}
-
-func (room *dmRoom) subscribe(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-	var mu sync.Mutex
-	var c *websocket.Conn
-	var closed bool
-	sub := &msgSubscriber{
-		msgs: make(chan models.DirectMessage, room.messageBuffer),
-		closeSlow: func() {
-			mu.Lock()
-			defer mu.Unlock()
-			closed = true
-			if c != nil {
-				c.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages.")
-			}
-		},
-	}
+	return room.subscribe(ctx, w, r, sub, handle)
+}
 
+func (room *dmRoom) subscribe(ctx context.Context, w http.ResponseWriter, r *http.Request, sub *msgSubscriber, handle frameHandler) error {
 	room.addSubscriber(sub)
 	defer room.deleteSubscriber(sub)
-
-	c2, err := websocket.Accept(w, r, nil)
-	if err != nil {
-		return err
-	}
-
-	mu.Lock()
-	if closed {
-		mu.Unlock()
-		return net.ErrClosed
-	}
-
-	c = c2
-	mu.Unlock()
-	defer c.CloseNow()
-	ctx = c.CloseRead(ctx)
-	for {
-		select {
-		case msg := <-sub.msgs:
-			err := writeTimeouts(ctx, time.Second*5, c, msg)
-			if err != nil {
-				return err
-			}
-		case <-ctx.Done():
-			return ctx.Err()
-		}
-	}
-
+	return sub.serve(ctx, w, r, handle)
 }
 
 func (room *dmRoom) addSubscriber(s *msgSubscriber) {
@@ -144,27 +123,158 @@ func (room *dmRoom) deleteSubscriber(s *msgSubscriber) {
 	delete(room.activeConns, s)
 }
 
-func (room *dmRoom) publish(msg models.DirectMessage) {
+// typing reports whether a typing event for the user should be relayed. They
+// are throttled per user and never persisted.
+func (room *dmRoom) typing(userId string) bool {
 	room.mu.Lock()
 	defer room.mu.Unlock()
 
-	// TODO: rate limiter
+	now := time.Now()
+	if now.Sub(room.lastTyping[userId]) < typingInterval {
+		return false
+	}
+	room.lastTyping[userId] = now
+	return true
+}
+
+// deliver sends an event received from the broker to every connection
+// subscribed on this instance, except the ones of the user except.
+func (room *dmRoom) deliver(ev event, except string) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	for s := range room.activeConns {
+		if except == "" || s.userId != except {
+			s.send(ev)
+		}
+	}
+}
+
+// closeAll closes every connection to the conversation.
+func (room *dmRoom) closeAll(code websocket.StatusCode, reason string) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
 
 	for s := range room.activeConns {
+		go s.close(code, reason)
+	}
+}
+
+func (sub *msgSubscriber) closeSlow() {
+	sub.close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages.")
+}
+
+// close closes the connection with the given status. A subscriber closed
+// before its connection is accepted never starts serving.
+func (sub *msgSubscriber) close(code websocket.StatusCode, reason string) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.closed = true
+	if sub.c != nil {
+		sub.c.Close(code, reason)
+	}
+}
+
+// send queues an event for this subscriber only, dropping it if the
+// subscriber is not keeping up.
+func (sub *msgSubscriber) send(ev event) {
+	select {
+	case sub.msgs <- ev:
+	default:
+		go sub.closeSlow()
+	}
+}
+
+// serve upgrades the request to a websocket, writes every event sent to the
+// subscriber and hands every frame read from the client to handle until the
+// connection or the context is closed.
+func (sub *msgSubscriber) serve(ctx context.Context, w http.ResponseWriter, r *http.Request, handle frameHandler) error {
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols: subprotocols,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Accept only picks a subprotocol we support, an empty one means the
+	// client didn't ask for any version we speak.
+	if c.Subprotocol() == "" {
+		c.Close(websocket.StatusProtocolError, errUnsupportedVersion.Error())
+		return errUnsupportedVersion
+	}
+
+	sub.mu.Lock()
+	if sub.closed {
+		sub.mu.Unlock()
+		c.CloseNow()
+		return net.ErrClosed
+	}
+
+	sub.c = c
+	sub.mu.Unlock()
+	defer c.CloseNow()
+	c.SetReadLimit(maxFrameSize)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- sub.readFrames(ctx, c, handle)
+	}()
+
+	for {
 		select {
-		case s.msgs <- msg:
+		case ev := <-sub.msgs:
+			err := writeTimeouts(ctx, time.Second*5, c, ev)
+			if err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readFrames decodes the frames sent by the client. Malformed frames, frames
+// for another protocol version and frames rejected by handle are answered with
+// an error event, the connection stays open.
+func (sub *msgSubscriber) readFrames(ctx context.Context, c *websocket.Conn, handle frameHandler) error {
+	for {
+		typ, b, err := c.Read(ctx)
+		if err != nil {
+			return err
+		}
+		if typ != websocket.MessageText {
+			sub.send(newErrorEvent(errInvalidFrame, ""))
+			continue
+		}
+
+		var f clientFrame
+		err = json.Unmarshal(b, &f)
+		if err != nil {
+			sub.send(newErrorEvent(errInvalidFrame, ""))
+			continue
+		}
+		if f.Version != protocolVersion {
+			sub.send(newErrorEvent(errUnsupportedVersion, f.ID))
+			continue
+		}
 
-		default:
-			go s.closeSlow()
+		err = handle(ctx, sub, f)
+		if err != nil {
+			sub.send(newErrorEvent(err, f.ID))
 		}
 	}
 }
 
-func writeTimeouts(ctx context.Context, timeout time.Duration, c *websocket.Conn, msg models.DirectMessage) error {
+func writeTimeouts(ctx context.Context, timeout time.Duration, c *websocket.Conn, ev event) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	m, err := msg.Serialize()
+	m, err := ev.Serialize()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBlockClosesConversation(t *testing.T) {
+	app := newTestApplication(t)
+	app.directMessageServer = serverDM()
+	room := newDMRoom()
+	app.directMessageServer.room["user-1:user-2"] = room
+
+	ctx, conns := dialRoom(t, room.subscribe, func() int {
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		return len(room.activeConns)
+	}, "user-1", "user-2")
+
+	// the topic is the same whoever blocks whom
+	app.publish(blockTopic("user-2", "user-1"), "", event{})
+	for _, c := range conns {
+		assertClosed(t, ctx, c, statusNotAllowed)
+	}
+}
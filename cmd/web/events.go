@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/validator"
+	"github.com/google/uuid"
+)
+
+// protocolVersion is the version of the envelope format spoken by the server.
+// Clients negotiate it through the websocket subprotocol and repeat it in every
+// frame they send.
+const protocolVersion = 1
+
+// subprotocols lists the websocket subprotocols the server accepts, one for
+// every supported protocol version.
+var subprotocols = []string{"message.v1"}
+
+// event types pushed to websocket subscribers
+const (
+	eventMessageCreated = "message.created"
+	eventMessageEdited  = "message.edited"
+	eventMessageDeleted = "message.deleted"
+	eventMessageRead    = "message.read"
+	eventConversation   = "conversation.updated"
+	eventTyping         = "typing"
+	eventPresence       = "presence"
+	eventFriendRequest  = "friend.request"
+	eventFriendAccepted = "friend.accepted"
+	eventError          = "error"
+)
+
+// frame types sent by clients over the websocket
+const (
+	frameSend     = "send"
+	frameTyping   = "typing"
+	frameAck      = "ack"
+	framePresence = "presence"
+)
+
+// typingInterval is the minimum time between two typing events relayed for the
+// same user in a room, extra typing frames are dropped.
+const typingInterval = 2 * time.Second
+
+// maxFrameSize limits the size of a single frame read from a client.
+const maxFrameSize = 8192
+
+// maxMessageLength is the longest message body accepted from a client.
+const maxMessageLength = 4000
+
+var (
+	errInvalidFrame       = errors.New("invalid frame")
+	errUnsupportedVersion = errors.New("unsupported protocol version")
+	errUnsupportedFrame   = errors.New("unsupported frame type")
+	errEmptyMessage       = errors.New("message can't be empty")
+	errMessageTooLong     = errors.New("message is too long")
+	errSendFailed         = errors.New("message could not be sent")
+	errAckFailed          = errors.New("message could not be marked as read")
+	errNotAMember         = errors.New("not a member of this group")
+	errNotAllowed         = errors.New("you can't message this user")
+	errFrameFailed        = errors.New("frame could not be handled")
+)
+
+// event is the envelope written to subscribers. The type tells the client
+// what the payload is so open chat windows can update in place.
+type event struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	Payload any    `json:"payload"`
+}
+
+// clientFrame is the envelope read from a subscriber. The payload is decoded
+// by the handler for its type.
+type clientFrame struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// sendPayload is the payload of a send frame.
+type sendPayload struct {
+	Body string `json:"body"`
+}
+
+// typingPayload is the payload of a typing event.
+type typingPayload struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// conversationPayload is the payload of a conversation.updated event, sent to
+// every connection of both participants when a new message is sent so
+// conversation lists can be reordered.
+type conversationPayload struct {
+	PeerID  string                `json:"peer_id"`
+	Message *models.DirectMessage `json:"message"`
+	Muted   bool                  `json:"muted,omitempty"` // don't count it as unread
+}
+
+// friendRequestPayload is the payload of friend.request events, sent to the
+// user asked, and friend.accepted events, sent to the user who asked. User is
+// the other person.
+type friendRequestPayload struct {
+	RequestID string `json:"request_id"`
+	UserID    string `json:"user_id"`
+	Name      string `json:"name"`
+}
+
+// ackPayload is the payload of an ack frame, sent by a client once a message
+// has been shown to the user.
+type ackPayload struct {
+	MessageID string `json:"message_id"`
+}
+
+// receiptPayload is the payload of a message.read event.
+type receiptPayload struct {
+	MessageID string    `json:"message_id"`
+	ReaderID  string    `json:"reader_id"`
+	ReadAt    time.Time `json:"read_at"`
+}
+
+// errorPayload is the payload of an error event. Ref is the id of the client
+// frame that caused the error, if any.
+type errorPayload struct {
+	Error      string `json:"error"`
+	Ref        string `json:"ref,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"` // milliseconds, for rate limit errors
+}
+
+func newEvent(eventType string, payload any) event {
+	return event{
+		Type:    eventType,
+		Version: protocolVersion,
+		ID:      uuid.NewString(),
+		Payload: payload,
+	}
+}
+
+func newErrorEvent(err error, ref string) event {
+	payload := errorPayload{Error: err.Error(), Ref: ref}
+	var limitErr *rateLimitError
+	if errors.As(err, &limitErr) {
+		payload.RetryAfter = int(limitErr.retryAfter.Milliseconds())
+	}
+	return newEvent(eventError, payload)
+}
+
+// decode unmarshals the frame payload into dst.
+func (f clientFrame) decode(dst any) error {
+	if len(f.Payload) == 0 {
+		return errInvalidFrame
+	}
+	err := json.Unmarshal(f.Payload, dst)
+	if err != nil {
+		return errInvalidFrame
+	}
+	return nil
+}
+
+func (e event) Serialize() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// validateMessageBody checks a message body sent over the websocket or posted
+// and returns it trimmed. Control characters other than tabs and line breaks
+// are dropped, search uses some of them to mark matches.
+func validateMessageBody(body string) (string, error) {
+	body = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return -1
+		}
+		return r
+	}, body)
+	body = strings.TrimSpace(body)
+	if !validator.NotBlank(body) {
+		return "", errEmptyMessage
+	}
+	if !validator.MaxChars(body, maxMessageLength) {
+		return "", errMessageTooLong
+	}
+	return body, nil
+}
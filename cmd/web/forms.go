@@ -18,11 +18,66 @@ type LogInForm struct {
 	validator.Validator `form:"-"`
 }
 
+type ForgotPasswordForm struct {
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
+
+type ResetPasswordForm struct {
+	Token               string `form:"token"`
+	Password            string `form:"password"`
+	ConfirmPassword     string `form:"confirmPassword"`
+	validator.Validator `form:"-"`
+}
+
+type TwoFactorForm struct {
+	Code                string `form:"code"`
+	validator.Validator `form:"-"`
+}
+
+type PasswordForm struct {
+	Password            string `form:"password"`
+	validator.Validator `form:"-"`
+}
+
+type IdentityForm struct {
+	Issuer  string `form:"issuer"`
+	Subject string `form:"subject"`
+}
+
 type DirectMessageForm struct {
 	Message    string `form:"message"`
 	SenderID   string `form:"senderId"`
 	ReceiverID string `form:"receiverId"`
 	CSRFToken  string `form:"csrf_token"`
 	Timezone   string `form:"timezone"`
-	//TODO: maybe validation to check if the sender can send direct methods to the receiver
+}
+
+type PrivacyForm struct {
+	AcceptMessages      string `form:"acceptMessages"`
+	validator.Validator `form:"-"`
+}
+
+type EditMessageForm struct {
+	Message string `form:"message"`
+}
+
+type GroupForm struct {
+	Name                string `form:"name"`
+	validator.Validator `form:"-"`
+}
+
+type GroupMemberForm struct {
+	UserID string `form:"userId"`
+}
+
+type GroupMessageForm struct {
+	Message   string `form:"message"`
+	CSRFToken string `form:"csrf_token"`
+	Timezone  string `form:"timezone"`
+}
+
+// RedirectForm carries the local path to go back to after a POST.
+type RedirectForm struct {
+	Next string `form:"next"`
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// friends shows the friends of the user and the friend requests they sent and
+// received.
+func (app *application) friends(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	friends, err := app.users.GetFriends(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	incoming, err := app.friendRequests.Incoming(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	outgoing, err := app.friendRequests.Outgoing(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.Users = friends
+	data.Incoming = incoming
+	data.Outgoing = outgoing
+	data.RequestCount = len(incoming)
+	app.render(w, http.StatusOK, "friends.html", data)
+}
+
+// addFriend sends a friend request to the user in the :id route parameter.
+func (app *application) addFriend(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	otherUserID := params.ByName("id")
+	if !validator.IsUUID(otherUserID) || otherUserID == userId {
+		app.notFound(w)
+		return
+	}
+	exists, err := app.users.Exists(otherUserID)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	if !exists {
+		app.notFound(w)
+		return
+	}
+
+	req, err := app.friendRequests.Send(userId, otherUserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrBlocked):
+			app.notFound(w)
+		case errors.Is(err, models.ErrAlreadyFriends), errors.Is(err, models.ErrDuplicateRequest):
+			http.Redirect(w, r, "/friends", http.StatusSeeOther)
+		default:
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	payload := friendRequestPayload{RequestID: req.ID.String(), UserID: userId, Name: user.Name}
+	if req.Status == models.RequestAccepted {
+		// they had already asked us, so this accepted their request
+		app.publish(userTopic(otherUserID), "", newEvent(eventFriendAccepted, payload))
+	} else {
+		app.publish(userTopic(otherUserID), "", newEvent(eventFriendRequest, payload))
+	}
+
+	var form RedirectForm
+	err = app.decodePostForm(r, &form)
+	if err != nil || !safeRedirect(form.Next) {
+		form.Next = "/friends"
+	}
+	http.Redirect(w, r, form.Next, http.StatusSeeOther)
+}
+
+func (app *application) removeFriend(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	params := httprouter.ParamsFromContext(r.Context())
+	otherUserID := params.ByName("id")
+	if !validator.IsUUID(otherUserID) {
+		app.notFound(w)
+		return
+	}
+
+	err := app.users.RemoveFriend(userId, otherUserID)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+}
+
+func (app *application) friendRequestAcceptPost(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	requestId := params.ByName("id")
+	if !validator.IsUUID(requestId) {
+		app.notFound(w)
+		return
+	}
+	req, err := app.friendRequests.Accept(requestId, userId)
+	if err != nil {
+		app.friendRequestError(w, err)
+		return
+	}
+
+	app.publish(userTopic(req.FromId), "", newEvent(eventFriendAccepted, friendRequestPayload{
+		RequestID: req.ID.String(),
+		UserID:    userId,
+		Name:      user.Name,
+	}))
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+}
+
+func (app *application) friendRequestDeclinePost(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	params := httprouter.ParamsFromContext(r.Context())
+	requestId := params.ByName("id")
+	if !validator.IsUUID(requestId) {
+		app.notFound(w)
+		return
+	}
+	_, err := app.friendRequests.Decline(requestId, userId)
+	if err != nil {
+		app.friendRequestError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+}
+
+func (app *application) friendRequestCancelPost(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	params := httprouter.ParamsFromContext(r.Context())
+	requestId := params.ByName("id")
+	if !validator.IsUUID(requestId) {
+		app.notFound(w)
+		return
+	}
+	err := app.friendRequests.Cancel(requestId, userId)
+	if err != nil {
+		app.friendRequestError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+}
+
+// friendRequestError answers a request for a friend request that doesn't
+// exist, isn't pending anymore or isn't the user's with a 404.
+func (app *application) friendRequestError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrNoRecord) {
+		app.notFound(w)
+		return
+	}
+	app.serverErrror(w, err)
+}
+
+// relationPost changes how the user relates to the user in the :id route
+// parameter with change, like blocking or muting them, and goes back to where
+// the request came from.
+func (app *application) relationPost(change func(userId, otherId string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+		params := httprouter.ParamsFromContext(r.Context())
+		otherUserID := params.ByName("id")
+		if !validator.IsUUID(otherUserID) || otherUserID == userId {
+			app.notFound(w)
+			return
+		}
+
+		err := change(userId, otherUserID)
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				app.notFound(w)
+			} else {
+				app.serverErrror(w, err)
+			}
+			return
+		}
+
+		var form RedirectForm
+		err = app.decodePostForm(r, &form)
+		if err != nil || !safeRedirect(form.Next) {
+			form.Next = "/friends"
+		}
+		http.Redirect(w, r, form.Next, http.StatusSeeOther)
+	}
+}
+
+// block blocks otherId for userId and closes the conversation the two have
+// open, on every instance.
+func (app *application) block(userId, otherId string) error {
+	err := app.policy.Block(userId, otherId)
+	if err != nil {
+		return err
+	}
+	app.publish(blockTopic(userId, otherId), "", event{})
+	return nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/validator"
+	"github.com/julienschmidt/httprouter"
+	"nhooyr.io/websocket"
+)
+
+// memberGroup loads the group from the :id route parameter and makes sure the
+// authenticated user is one of its members. It writes the error response itself
+// and returns false when the request should not continue.
+func (app *application) memberGroup(w http.ResponseWriter, r *http.Request) (*models.Group, bool) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	params := httprouter.ParamsFromContext(r.Context())
+	groupId := params.ByName("id")
+	if !validator.IsUUID(groupId) {
+		app.notFound(w)
+		return nil, false
+	}
+
+	group, err := app.groups.Get(groupId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return nil, false
+	}
+
+	isMember, err := app.groups.IsMember(groupId, userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return nil, false
+	}
+	if !isMember {
+		app.notFound(w)
+		return nil, false
+	}
+	return group, true
+}
+
+func (app *application) groupList(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	groups, err := app.groups.GetGroupsForUser(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.Groups = groups
+	data.Form = GroupForm{}
+	app.render(w, http.StatusOK, "group_list.html", data)
+}
+
+func (app *application) groupCreatePost(w http.ResponseWriter, r *http.Request) {
+	var form GroupForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Name), "name", "Name can't be empty.")
+	form.CheckField(validator.MaxChars(form.Name, 255), "name", "Name can't be longer than 255 characters.")
+
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	if !form.Valid() {
+		user, err := app.users.Get(userId)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		groups, err := app.groups.GetGroupsForUser(userId)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		data := app.newTemplateData(r)
+		data.User = user
+		data.Groups = groups
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "group_list.html", data)
+		return
+	}
+
+	id, err := app.groups.Insert(form.Name, userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	http.Redirect(w, r, "/group/"+id.String(), http.StatusSeeOther)
+}
+
+func (app *application) groupView(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.memberGroup(w, r)
+	if !ok {
+		return
+	}
+	groupId := group.ID.String()
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	data := app.newTemplateData(r)
+
+	// ?at= opens the group around a message, like direct conversations
+	var messages []*models.GroupMessage
+	var err error
+	if at := r.URL.Query().Get("at"); validator.IsUUID(at) {
+		half := models.DefaultPageSize / 2
+		older, err := app.groupMessages.GetMessagesForGroup(groupId, models.Page{Before: at, Limit: half})
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		newer, err := app.groupMessages.GetMessagesForGroup(groupId, models.Page{From: at, Limit: half + 1})
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		if len(newer) > half {
+			newer = newer[:half]
+			data.HasNewer = true
+		}
+		messages = append(older, newer...)
+		data.FocusID = at
+	} else {
+		messages, err = app.groupMessages.GetMessagesForGroup(groupId, models.Page{})
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+	}
+
+	members, err := app.groups.GetMembers(groupId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	friends, err := app.users.GetFriends(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	// only offer the friends that are not already in the group
+	inGroup := make(map[string]bool, len(members))
+	for _, member := range members {
+		inGroup[member.ID.String()] = true
+	}
+	candidates := []*models.User{}
+	for _, friend := range friends {
+		if !inGroup[friend.ID.String()] {
+			candidates = append(candidates, friend)
+		}
+	}
+
+	data.Group = group
+	data.GroupMessages = messages
+	data.Members = members
+	data.Users = candidates
+	data.Heading = group.Name
+	app.render(w, http.StatusOK, "group.html", data)
+}
+
+// groupHistory returns a page of group messages around a message id cursor,
+// like directMessageHistory.
+func (app *application) groupHistory(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.memberGroup(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	page, ok := historyPage(query)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// ask for one extra row to know if there is anything past this page
+	limit := page.Limit
+	page.Limit++
+	messages, err := app.groupMessages.GetMessagesForGroup(group.ID.String(), page)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	messages, hasMore := trimHistory(messages, page, limit)
+
+	if query.Get("format") == "html" {
+		data := app.newTemplateData(r)
+		data.GroupMessages = messages
+		w.Header().Set("X-Has-More", strconv.FormatBool(hasMore))
+		app.renderFragment(w, http.StatusOK, "group.html", "group_messages", data)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]any{
+		"messages": messages,
+		"has_more": hasMore,
+	})
+}
+
+func (app *application) groupAddMemberPost(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.memberGroup(w, r)
+	if !ok {
+		return
+	}
+
+	var form GroupMemberForm
+	err := app.decodePostForm(r, &form)
+	if err != nil || !validator.IsUUID(form.UserID) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// members can only bring in people they are friends with
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	isFriend, err := app.users.IsFriend(userId, form.UserID)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	if !isFriend {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	err = app.groups.AddMember(group.ID.String(), form.UserID)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	http.Redirect(w, r, "/group/"+group.ID.String(), http.StatusSeeOther)
+}
+
+func (app *application) groupRemoveMemberPost(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.memberGroup(w, r)
+	if !ok {
+		return
+	}
+
+	var form GroupMemberForm
+	err := app.decodePostForm(r, &form)
+	if err != nil || !validator.IsUUID(form.UserID) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// the owner can remove anyone, everyone else can only leave
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	if form.UserID != userId && group.OwnerID != userId {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+	// nobody could manage the group once its owner is gone
+	if form.UserID == group.OwnerID {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.groups.RemoveMember(group.ID.String(), form.UserID)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	// their open connections would keep receiving the group messages
+	app.publish(memberTopic(group.ID.String(), form.UserID), "", event{})
+
+	if form.UserID == userId {
+		http.Redirect(w, r, "/group", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/group/"+group.ID.String(), http.StatusSeeOther)
+}
+
+func (app *application) groupSubscriberHandler(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.memberGroup(w, r)
+	if !ok {
+		return
+	}
+
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusUnauthorized)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	sub := newSubscriber(userId, app.sessionManager.GetString(r.Context(), "sessionID"), user.Name)
+	app.connect(sub)
+	defer app.disconnect(sub)
+	err = app.groupMessageServer.getGroup(group.ID.String()).subscribe(r.Context(), w, r, sub, app.withPresence(app.groupMessageFrames(group)))
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if websocket.CloseStatus(err) == websocket.StatusNormalClosure || websocket.CloseStatus(err) == websocket.StatusGoingAway {
+		return
+	}
+
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+}
+
+// groupMessageFrames handles the frames a subscriber sends in a group. Groups
+// have no read receipts, ack frames are unsupported like any unknown type.
+func (app *application) groupMessageFrames(group *models.Group) frameHandler {
+	groupId := group.ID.String()
+	return func(ctx context.Context, sub *msgSubscriber, f clientFrame) error {
+		switch f.Type {
+		case frameSend:
+			var payload sendPayload
+			err := f.decode(&payload)
+			if err != nil {
+				return err
+			}
+			body, err := validateMessageBody(payload.Body)
+			if err != nil {
+				return err
+			}
+
+			// members can be removed while they are still connected
+			isMember, err := app.groups.IsMember(groupId, sub.userId)
+			if err != nil {
+				app.errorLog.Println(err)
+				return errSendFailed
+			}
+			if !isMember {
+				return errNotAMember
+			}
+			err = app.allowSend(sub.userId, groupTopic(groupId))
+			if err != nil {
+				return err
+			}
+
+			msg, err := app.groupMessages.Send(sub.userId, groupId, body)
+			if err != nil {
+				app.errorLog.Println(err)
+				return errSendFailed
+			}
+			msg.Sender = sub.name
+			msg.Receiver = group.Name
+			app.publish(groupTopic(groupId), "", newEvent(eventMessageCreated, msg))
+			return nil
+		case frameTyping:
+			if app.groupMessageServer.getGroup(groupId).typing(sub.userId) {
+				app.publish(groupTopic(groupId), sub.userId,
+					newEvent(eventTyping, typingPayload{UserID: sub.userId, Name: sub.name}))
+			}
+			return nil
+		default:
+			return errUnsupportedFrame
+		}
+	}
+}
+
+func (app *application) groupMessagePost(w http.ResponseWriter, r *http.Request) {
+	group, ok := app.memberGroup(w, r)
+	if !ok {
+		return
+	}
+
+	var form GroupMessageForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	body, err := validateMessageBody(form.Message)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	senderId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(senderId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	groupId := group.ID.String()
+	err = app.allowSend(senderId, groupTopic(groupId))
+	if app.rateLimited(w, err) {
+		return
+	}
+	msg, err := app.groupMessages.Send(senderId, groupId, body)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	msg.Sender = user.Name
+	msg.Receiver = group.Name
+	app.publish(groupTopic(groupId), "", newEvent(eventMessageCreated, msg))
+	w.WriteHeader(http.StatusAccepted)
+}
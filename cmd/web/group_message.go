@@ -1,9 +1,117 @@
 package main
 
-import "sync"
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// statusNotAMember closes the group connections of a member who was removed,
+// clients stop reconnecting to the group.
+const statusNotAMember websocket.StatusCode = 4003
+
+type groupMsgServer struct {
+	groups map[string]*msgGroup
+	mu     sync.Mutex
+}
 
 type msgGroup struct {
-	messageBuffer int
-	mu            sync.Mutex
-	activeConns   map[*msgSubscriber]struct{}
+	mu          sync.Mutex
+	activeConns map[*msgSubscriber]struct{}
+	lastTyping  map[string]time.Time
+}
+
+func serverGroup() *groupMsgServer {
+	return &groupMsgServer{
+		groups: make(map[string]*msgGroup),
+	}
+}
+
+func newMsgGroup() *msgGroup {
+	return &msgGroup{
+		activeConns: make(map[*msgSubscriber]struct{}),
+		lastTyping:  make(map[string]time.Time),
+	}
+}
+
+// getGroup returns the room for the group, creating it on first use.
+func (s *groupMsgServer) getGroup(groupId string) *msgGroup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.groups[groupId]
+	if !ok {
+		group = newMsgGroup()
+		s.groups[groupId] = group
+	}
+	return group
+}
+
+// lookupGroup returns the room for the group if anyone subscribed to it on
+// this instance.
+func (s *groupMsgServer) lookupGroup(groupId string) (*msgGroup, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	group, ok := s.groups[groupId]
+	return group, ok
+}
+
+func (group *msgGroup) subscribe(ctx context.Context, w http.ResponseWriter, r *http.Request, sub *msgSubscriber, handle frameHandler) error {
+	group.addSubscriber(sub)
+	defer group.deleteSubscriber(sub)
+	return sub.serve(ctx, w, r, handle)
+}
+
+func (group *msgGroup) addSubscriber(s *msgSubscriber) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	group.activeConns[s] = struct{}{}
+}
+
+func (group *msgGroup) deleteSubscriber(s *msgSubscriber) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	delete(group.activeConns, s)
+}
+
+// typing reports whether a typing event for the user should be relayed. They
+// are throttled per user and never persisted.
+func (group *msgGroup) typing(userId string) bool {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(group.lastTyping[userId]) < typingInterval {
+		return false
+	}
+	group.lastTyping[userId] = now
+	return true
+}
+
+// deliver sends an event received from the broker to every connection
+// subscribed on this instance, except the ones of the user except.
+func (group *msgGroup) deliver(ev event, except string) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	for s := range group.activeConns {
+		if except == "" || s.userId != except {
+			s.send(ev)
+		}
+	}
+}
+
+// closeUser closes the connections of the user to this group.
+func (group *msgGroup) closeUser(userId string, code websocket.StatusCode, reason string) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	for s := range group.activeConns {
+		if s.userId == userId {
+			go s.close(code, reason)
+		}
+	}
 }
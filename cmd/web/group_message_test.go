@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGroupRemovedMemberDisconnected(t *testing.T) {
+	app := newTestApplication(t)
+	app.groupMessageServer = serverGroup()
+	group := app.groupMessageServer.getGroup("group-1")
+
+	ctx, conns := dialRoom(t, group.subscribe, func() int {
+		group.mu.Lock()
+		defer group.mu.Unlock()
+		return len(group.activeConns)
+	}, "user-1", "user-2")
+	removed, stays := conns[0], conns[1]
+
+	app.publish(memberTopic("group-1", "user-1"), "", event{})
+	assertClosed(t, ctx, removed, statusNotAMember)
+
+	app.publish(groupTopic("group-1"), "", newEvent(eventTyping, typingPayload{UserID: "user-3"}))
+	_, data, err := stays.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), eventTyping) {
+		t.Errorf("got %s", data)
+	}
+}
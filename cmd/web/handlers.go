@@ -6,7 +6,6 @@ import (
 
 	"github.com/Tsundere-Musume/message/internal/models"
 	"github.com/Tsundere-Musume/message/internal/validator"
-	"github.com/julienschmidt/httprouter"
 )
 
 func (app *application) home(w http.ResponseWriter, r *http.Request) {
@@ -50,7 +49,7 @@ func (app *application) userSignUpPost(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	err = app.users.Insert(form.Name, form.Email, form.Password, filename)
+	id, err := app.users.Insert(form.Name, form.Email, form.Password, filename)
 	if err != nil {
 		if errors.Is(err, models.ErrDuplicateEmail) {
 			form.AddFieldError("email", "Email address is already in use")
@@ -62,6 +61,9 @@ func (app *application) userSignUpPost(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+
+	app.sendVerification(&models.User{ID: id, Name: form.Name, Email: form.Email})
+	app.sessionManager.Put(r.Context(), "flash", "Check your email for a link to verify your address.")
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 }
 
@@ -105,49 +107,106 @@ func (app *application) userLogInPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.sessionManager.RenewToken(r.Context())
+	twoFactor, err := app.startTwoFactor(r, id.String())
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	if twoFactor {
+		http.Redirect(w, r, "/user/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	err = app.logIn(r, id.String())
 	if err != nil {
 		app.serverErrror(w, err)
 		return
 	}
-	app.sessionManager.Put(r.Context(), "authenticatedUserID", id.String())
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (app *application) userLogOutPost(w http.ResponseWriter, r *http.Request) {
-	err := app.sessionManager.RenewToken(r.Context())
+	err := app.logOut(r)
 	if err != nil {
 		app.serverErrror(w, err)
 		return
 	}
-	app.sessionManager.Remove(r.Context(), "authenticatedUserID")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+const directoryPageSize = 20
+
+// userList is the user directory, where people find others to add as friends.
+// It takes the same q and offset parameters as the search.
 func (app *application) userList(w http.ResponseWriter, r *http.Request) {
-	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
-	user, err := app.users.Get(userId)
+	query, offset, ok := searchParams(r)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
 
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	entries, err := app.users.Directory(userId, query, directoryPageSize+1, offset)
 	if err != nil {
-		if errors.Is(err, models.ErrNoRecord) {
-			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
-		} else {
-			app.serverErrror(w, err)
-		}
+		app.serverErrror(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Query = query
+	if len(entries) > directoryPageSize {
+		entries = entries[:directoryPageSize]
+		data.NextOffset = offset + directoryPageSize
+	}
+	data.Directory = entries
+	app.render(w, http.StatusOK, "users.html", data)
+}
+
+func (app *application) userListJSON(w http.ResponseWriter, r *http.Request) {
+	query, offset, ok := searchParams(r)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	users, err := app.users.GetAllUsers(userId)
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	entries, err := app.users.Directory(userId, query, directoryPageSize+1, offset)
 	if err != nil {
 		app.serverErrror(w, err)
 		return
 	}
 
-	data := app.newTemplateData(r)
-	data.User = user
-	data.Users = users
+	next := 0
+	if len(entries) > directoryPageSize {
+		entries = entries[:directoryPageSize]
+		next = offset + directoryPageSize
+	}
 
-	app.render(w, http.StatusOK, "user_list.html", data)
+	// only what the directory shows, never the email
+	type user struct {
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+		Friend    bool   `json:"friend"`
+		Requested bool   `json:"requested"`
+		Incoming  bool   `json:"incoming"`
+	}
+	out := make([]user, 0, len(entries))
+	for _, entry := range entries {
+		out = append(out, user{
+			ID:        entry.User.ID.String(),
+			Name:      entry.User.Name,
+			AvatarURL: "/uploads/" + entry.User.AvatarUrl,
+			Friend:    entry.Friend,
+			Requested: entry.Requested,
+			Incoming:  entry.Incoming,
+		})
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]any{
+		"users":       out,
+		"next_offset": next,
+	})
 }
 
 func (app *application) friendList(w http.ResponseWriter, r *http.Request) {
@@ -163,55 +222,34 @@ func (app *application) friendList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, err := app.users.GetFriends(userId)
+	conversations, err := app.directMessages.Conversations(userId)
 	if err != nil {
 		app.serverErrror(w, err)
 		return
 	}
 
-	data := app.newTemplateData(r)
-	data.User = user
-	data.Users = users
-
-	app.render(w, http.StatusOK, "user_list.html", data)
-}
-
-func (app *application) addFriend(w http.ResponseWriter, r *http.Request) {
-	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
-
-	//get it from a post form
-	params := httprouter.ParamsFromContext(r.Context())
-	otherUserID := params.ByName("id")
-	if otherUserID == "" {
-		app.notFound(w)
-		return
+	// presence is only shared between friends
+	friends := make([]*models.User, 0, len(conversations))
+	for _, conversation := range conversations {
+		if conversation.IsFriend {
+			friends = append(friends, conversation.User)
+		}
 	}
 
-	err := app.users.AddFriend(userId, otherUserID)
+	data := app.newTemplateData(r)
+	data.User = user
+	data.Conversations = conversations
+	data.Presence = app.friendStatuses(friends)
+	data.Unread, err = app.directMessages.UnreadCounts(userId)
 	if err != nil {
-		//TODO: handle errors for constraint better
-		app.clientError(w, http.StatusBadRequest)
-		return
-	}
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-func (app *application) removeFriend(w http.ResponseWriter, r *http.Request) {
-	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
-
-	params := httprouter.ParamsFromContext(r.Context())
-	otherUserID := params.ByName("id")
-	if otherUserID == "" {
-		app.notFound(w)
+		app.serverErrror(w, err)
 		return
 	}
-
-	err := app.users.RemoveFriend(userId, otherUserID)
+	data.RequestCount, err = app.friendRequests.IncomingCount(userId)
 	if err != nil {
-		//TODO: handle errors for constraint better
-		app.clientError(w, http.StatusBadRequest)
+		app.serverErrror(w, err)
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	app.render(w, http.StatusOK, "user_list.html", data)
 }
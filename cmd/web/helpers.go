@@ -1,13 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/Tsundere-Musume/message/internal/mailer"
 	"github.com/Tsundere-Musume/message/internal/models"
 	"github.com/go-playground/form/v4"
 	"github.com/google/uuid"
@@ -42,12 +46,49 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 	}
 }
 
+// renderFragment executes a single named template from a page without the base
+// layout, used to send partial html to scripts.
+func (app *application) renderFragment(w http.ResponseWriter, status int, page, name string, data *templateData) {
+	tmpl, ok := app.templates[page]
+	if !ok {
+		err := fmt.Errorf("template %s does not exist", page)
+		app.serverErrror(w, err)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	err := tmpl.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+func (app *application) writeJSON(w http.ResponseWriter, status int, data any) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
 func (app *application) newTemplateData(r *http.Request) *templateData {
 	userID := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
 	return &templateData{
 		UserID:          userID,
+		Flash:           app.sessionManager.PopString(r.Context(), "flash"),
 		CSRFToken:       nosurf.Token(r),
 		IsAuthenticated: app.isAuthenticated(r),
+		Unverified:      app.isAuthenticated(r) && !app.isVerified(r),
+		SSO:             app.oidc != nil,
 	}
 }
 
@@ -75,6 +116,12 @@ func (app *application) isAuthenticated(r *http.Request) bool {
 	return isAuthenticated
 }
 
+// isVerified reports whether the logged in user verified their email address.
+func (app *application) isVerified(r *http.Request) bool {
+	verified, ok := r.Context().Value(isVerifiedContextKey).(bool)
+	return ok && verified
+}
+
 // func serializeMessage(msg message) ([]byte, error) {
 // 	val, err := json.Marshal(msg)
 // 	if err != nil {
@@ -109,7 +156,7 @@ func (app *application) uploadAvatar(r *http.Request) (string, error) {
 
 	fileExt := filepath.Ext(fileHeaders.Filename)
 	filename := uuid.NewString() + fileExt
-	outFile, err := os.Create("./ui/static/images/" + filename)
+	outFile, err := os.Create(filepath.Join(app.config.uploadDir, filename))
 	if err != nil {
 		return "", err
 	}
@@ -121,3 +168,25 @@ func (app *application) uploadAvatar(r *http.Request) (string, error) {
 	}
 	return filename, nil
 }
+
+// safeRedirect reports whether next is a path on this site, so it can't be
+// used to send users elsewhere.
+func safeRedirect(next string) bool {
+	return strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\")
+}
+
+// sendMail sends msg in the background, failures are only logged.
+func (app *application) sendMail(msg mailer.Message) {
+	app.background(func() {
+		err := app.mailer.Send(msg)
+		if err != nil {
+			app.errorLog.Printf("Mailing %s: %s", msg.To, err)
+		}
+	})
+}
+
+// link returns the absolute url of path, for links that leave the site like
+// the ones in emails.
+func (app *application) link(path string) string {
+	return strings.TrimSuffix(app.config.baseURL, "/") + path
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/validator"
 	"github.com/julienschmidt/httprouter"
 	"nhooyr.io/websocket"
 )
@@ -16,7 +19,7 @@ func (app *application) directMessage(w http.ResponseWriter, r *http.Request) {
 
 	params := httprouter.ParamsFromContext(r.Context())
 	receiverId := params.ByName("id")
-	if receiverId == "" {
+	if !validator.IsUUID(receiverId) {
 		app.notFound(w)
 		return
 	}
@@ -26,24 +29,207 @@ func (app *application) directMessage(w http.ResponseWriter, r *http.Request) {
 		app.notFound(w)
 		return
 	}
-	messages, err := app.directMessages.GetMessagesForUser(senderId, receiverId)
+	// someone who blocked the viewer is out of their reach, page included
+	blockedBy, err := app.policy.HasBlocked(receiverId, senderId)
 	if err != nil {
 		app.serverErrror(w, err)
 		return
 	}
+	if blockedBy {
+		app.notFound(w)
+		return
+	}
 	data := app.newTemplateData(r)
+
+	// ?at= opens the conversation around a message, e.g. from search results,
+	// instead of at the latest messages
+	var messages []*models.DirectMessage
+	if at := r.URL.Query().Get("at"); validator.IsUUID(at) {
+		half := models.DefaultPageSize / 2
+		older, err := app.directMessages.GetMessagesForUser(senderId, receiverId, models.Page{Before: at, Limit: half})
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		newer, err := app.directMessages.GetMessagesForUser(senderId, receiverId, models.Page{From: at, Limit: half + 1})
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		if len(newer) > half {
+			newer = newer[:half]
+			data.HasNewer = true
+		}
+		messages = append(older, newer...)
+		data.FocusID = at
+	} else {
+		messages, err = app.directMessages.GetMessagesForUser(senderId, receiverId, models.Page{})
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+	}
+
+	seenId, err := app.directMessages.LastRead(receiverId, senderId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	// the history stays readable, the conversation just can't go on
+	canMessage, err := app.policy.CanMessage(senderId, receiverId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	data.CanMessage = canMessage
+	data.IsBlocked, err = app.policy.HasBlocked(senderId, receiverId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	data.IsMuted, err = app.policy.IsMuted(senderId, receiverId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	data.SeenID = seenId
 	data.Messages = messages
 	data.Heading = recv.Name
+	data.ReceiverID = receiverId
+	// presence is only shared between friends, like presenceChanged does
+	isFriend, err := app.users.IsFriend(senderId, receiverId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	isBlocked, err := app.policy.IsBlocked(senderId, receiverId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	if isFriend && !isBlocked {
+		data.Presence = map[string]string{receiverId: app.presence.status(receiverId)}
+	}
 	app.render(w, http.StatusOK, "message.html", data)
 
 }
 
+// historyPage reads the before, after and limit parameters of a history
+// request, ok is false if any of them is invalid.
+func historyPage(query url.Values) (models.Page, bool) {
+	page := models.Page{
+		Before: query.Get("before"),
+		After:  query.Get("after"),
+		Limit:  models.DefaultPageSize,
+	}
+	for _, cursor := range []string{page.Before, page.After} {
+		if cursor != "" && !validator.IsUUID(cursor) {
+			return models.Page{}, false
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > models.MaxPageSize {
+			return models.Page{}, false
+		}
+		page.Limit = n
+	}
+	return page, true
+}
+
+// trimHistory drops the extra message loaded past a page of limit messages
+// and reports whether there was one.
+func trimHistory[T any](messages []T, page models.Page, limit int) ([]T, bool) {
+	if len(messages) <= limit {
+		return messages, false
+	}
+	if page.After != "" {
+		return messages[:limit], true
+	}
+	return messages[1:], true
+}
+
+// directMessageHistory returns a page of older (or newer) messages around a
+// message id cursor, either as json or as html fragments ready to be inserted
+// into the message log.
+func (app *application) directMessageHistory(w http.ResponseWriter, r *http.Request) {
+	senderId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+
+	params := httprouter.ParamsFromContext(r.Context())
+	receiverId := params.ByName("id")
+	if !validator.IsUUID(receiverId) {
+		app.notFound(w)
+		return
+	}
+
+	blockedBy, err := app.policy.HasBlocked(receiverId, senderId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	if blockedBy {
+		app.notFound(w)
+		return
+	}
+
+	query := r.URL.Query()
+	page, ok := historyPage(query)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	// ask for one extra row to know if there is anything past this page
+	limit := page.Limit
+	page.Limit++
+	messages, err := app.directMessages.GetMessagesForUser(senderId, receiverId, page)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	messages, hasMore := trimHistory(messages, page, limit)
+
+	if query.Get("format") == "html" {
+		data := app.newTemplateData(r)
+		data.Messages = messages
+		w.Header().Set("X-Has-More", strconv.FormatBool(hasMore))
+		app.renderFragment(w, http.StatusOK, "message.html", "messages", data)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]any{
+		"messages": messages,
+		"has_more": hasMore,
+	})
+}
+
 func (app *application) subscriberHandler(w http.ResponseWriter, r *http.Request) {
 	senderId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
-	//TODO: validate id
-	ctx := context.WithValue(r.Context(), userIdKey, senderId)
-	r = r.WithContext(ctx)
-	err := app.directMessageServer.subscribe(r.Context(), w, r)
+	user, err := app.users.Get(senderId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusUnauthorized)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	receiverId := params.ByName("id")
+	if !validator.IsUUID(receiverId) {
+		app.notFound(w)
+		return
+	}
+	if !app.allowedToMessage(w, senderId, receiverId) {
+		return
+	}
+
+	sub := newSubscriber(senderId, app.sessionManager.GetString(r.Context(), "sessionID"), user.Name)
+	app.connect(sub)
+	defer app.disconnect(sub)
+	err = app.directMessageServer.subscribe(r.Context(), w, r, sub, app.withPresence(app.directMessageFrames(receiverId)))
 	if errors.Is(err, context.Canceled) {
 		return
 	}
@@ -65,6 +251,86 @@ func (app *application) subscriberHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// directMessageFrames handles the frames a subscriber sends in a direct
+// conversation with receiverId.
+func (app *application) directMessageFrames(receiverId string) frameHandler {
+	return func(ctx context.Context, sub *msgSubscriber, f clientFrame) error {
+		// friendships and blocks can change while connected, no frame gets
+		// through once the users can't message each other
+		canMessage, err := app.policy.CanMessage(sub.userId, receiverId)
+		if err != nil {
+			app.errorLog.Println(err)
+			return errFrameFailed
+		}
+		if !canMessage {
+			return errNotAllowed
+		}
+
+		switch f.Type {
+		case frameSend:
+			var payload sendPayload
+			err := f.decode(&payload)
+			if err != nil {
+				return err
+			}
+			body, err := validateMessageBody(payload.Body)
+			if err != nil {
+				return err
+			}
+
+			err = app.allowSend(sub.userId, directTopic(sub.userId, receiverId))
+			if err != nil {
+				return err
+			}
+			msg, err := app.directMessages.Send(sub.userId, receiverId, body)
+			if err != nil {
+				app.errorLog.Println(err)
+				return errSendFailed
+			}
+			msg.Sender = sub.name
+			app.publishDirect(msg, eventMessageCreated)
+			app.notifyConversation(msg)
+			return nil
+		case frameTyping:
+			room, ok := app.directMessageServer.getRoomByIds(sub.userId, receiverId)
+			if ok && room.typing(sub.userId) {
+				app.publish(directTopic(sub.userId, receiverId), sub.userId,
+					newEvent(eventTyping, typingPayload{UserID: sub.userId, Name: sub.name}))
+			}
+			return nil
+		case frameAck:
+			var payload ackPayload
+			err := f.decode(&payload)
+			if err != nil {
+				return err
+			}
+			if !validator.IsUUID(payload.MessageID) {
+				return errInvalidFrame
+			}
+			read, err := app.directMessages.MarkRead(sub.userId, receiverId, payload.MessageID)
+			if err != nil {
+				app.errorLog.Println(err)
+				return errAckFailed
+			}
+			if !read {
+				return nil
+			}
+
+			// the room has the sender in it if they are looking at the
+			// conversation, and the reader's other tabs so they can clear
+			// their unread badges
+			app.publish(directTopic(sub.userId, receiverId), "", newEvent(eventMessageRead, receiptPayload{
+				MessageID: payload.MessageID,
+				ReaderID:  sub.userId,
+				ReadAt:    time.Now().UTC(),
+			}))
+			return nil
+		default:
+			return errUnsupportedFrame
+		}
+	}
+}
+
 func (app *application) directMessagePost(w http.ResponseWriter, r *http.Request) {
 	// body := http.MaxBytesReader(w, r.Body, 8192)
 	// fmt.Println(r.Body)
@@ -94,25 +360,127 @@ func (app *application) directMessagePost(w http.ResponseWriter, r *http.Request
 		}
 		return
 	}
-	err = app.directMessages.Send(senderId, form.ReceiverID, form.Message)
+
+	if !validator.IsUUID(form.ReceiverID) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	body, err := validateMessageBody(form.Message)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	if !app.allowedToMessage(w, senderId, form.ReceiverID) {
+		return
+	}
+
+	err = app.allowSend(senderId, directTopic(senderId, form.ReceiverID))
+	if app.rateLimited(w, err) {
+		return
+	}
+	msg, err := app.directMessages.Send(senderId, form.ReceiverID, body)
 	if err != nil {
 		app.serverErrror(w, err)
 		return
 	}
 
-	msg := models.DirectMessage{
-		FromId:  senderId,
-		ToId:    form.ReceiverID,
-		Body:    form.Message,
-		Created: time.Now().UTC(),
-		Sender:  user.Name,
+	msg.Sender = user.Name
+	app.publishDirect(msg, eventMessageCreated)
+	app.notifyConversation(msg)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// allowedToMessage checks the message policy between the two users. It writes
+// the error response itself and returns false when the request should not
+// continue.
+func (app *application) allowedToMessage(w http.ResponseWriter, senderId, receiverId string) bool {
+	canMessage, err := app.policy.CanMessage(senderId, receiverId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return false
 	}
-	//validate user id
-	room, ok := app.directMessageServer.getRoomByIds(msg.FromId, msg.ToId)
-	if !ok {
+	if !canMessage {
+		app.clientError(w, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (app *application) directMessageEditPost(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	messageId := params.ByName("id")
+	if !validator.IsUUID(messageId) {
 		app.notFound(w)
 		return
 	}
-	room.publish(msg)
+
+	var form EditMessageForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+	body, err := validateMessageBody(form.Message)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	senderId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	msg, err := app.directMessages.Edit(messageId, senderId, body)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	app.publishDirect(msg, eventMessageEdited)
 	w.WriteHeader(http.StatusAccepted)
 }
+
+func (app *application) directMessageDeletePost(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	messageId := params.ByName("id")
+	if !validator.IsUUID(messageId) {
+		app.notFound(w)
+		return
+	}
+
+	senderId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	msg, err := app.directMessages.Delete(messageId, senderId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	app.publishDirect(msg, eventMessageDeleted)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// publishDirect pushes an event about msg to everyone subscribed to the
+// conversation it belongs to.
+func (app *application) publishDirect(msg *models.DirectMessage, eventType string) {
+	app.publish(directTopic(msg.FromId, msg.ToId), "", newEvent(eventType, msg))
+}
+
+// notifyConversation tells both participants, wherever they are connected,
+// that the conversation has a new latest message.
+func (app *application) notifyConversation(msg *models.DirectMessage) {
+	muted, err := app.policy.IsMuted(msg.ToId, msg.FromId)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	app.publish(userTopic(msg.ToId), "", newEvent(eventConversation, conversationPayload{PeerID: msg.FromId, Message: msg, Muted: muted}))
+	app.publish(userTopic(msg.FromId), "", newEvent(eventConversation, conversationPayload{PeerID: msg.ToId, Message: msg}))
+}
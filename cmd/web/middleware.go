@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"net"
 	"net/http"
 
+	"github.com/Tsundere-Musume/message/internal/models"
 	"github.com/justinas/nosurf"
 )
 
@@ -15,6 +18,9 @@ func secureHeaders(next http.Handler) http.Handler {
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.Header().Set("X-Frame-Options", "deny")
 		w.Header().Set("X-XSS-Protection", "0")
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", "max-age=63072000")
+		}
 
 		next.ServeHTTP(w, r)
 	})
@@ -46,25 +52,57 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		exists, err := app.users.Exists(userId)
+		// sessions logged out from elsewhere are only removed from the
+		// table, they find out here
+		err := app.sessions.Touch(app.sessionManager.GetString(r.Context(), "sessionID"), userId, clientIP(r))
 		if err != nil {
+			if !errors.Is(err, models.ErrNoRecord) {
+				app.serverErrror(w, err)
+				return
+			}
+			app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+			app.sessionManager.Remove(r.Context(), "sessionID")
 			next.ServeHTTP(w, r)
 			return
 		}
-		if exists {
-			ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, exists)
-			r = r.WithContext(ctx)
+
+		// a deleted user is logged out, a failing database shouldn't look
+		// like that
+		verified, err := app.users.IsVerified(userId)
+		if err != nil {
+			if !errors.Is(err, models.ErrNoRecord) {
+				app.serverErrror(w, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
 		}
+		ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
+		ctx = context.WithValue(ctx, isVerifiedContextKey, verified)
+		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
 	})
 }
 
-func noSurf(next http.Handler) http.Handler {
+func (app *application) noSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
-		Secure:   true,
+		Secure:   app.config.secureCookies || app.config.tlsEnabled(),
 	})
 	return csrfHandler
 }
+
+// localOnly only lets requests from the machine itself through, for debug
+// endpoints.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
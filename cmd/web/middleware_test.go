@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// failingSessions is a session table that can't be reached.
+type failingSessions struct {
+	*fakeSessions
+}
+
+func (f failingSessions) Touch(id, userId, ip string) error {
+	return errors.New("connection refused")
+}
+
+func TestAuthenticateSessionErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		failing    bool
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "revoked session",
+			wantStatus: http.StatusOK,
+			wantBody:   "user=",
+		},
+		{
+			name:       "database error",
+			failing:    true,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			if tt.failing {
+				app.sessions = failingSessions{newFakeSessions()}
+			}
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /test/login/{id}", func(w http.ResponseWriter, r *http.Request) {
+				app.sessionManager.Put(r.Context(), "authenticatedUserID", r.PathValue("id"))
+			})
+			mux.Handle("/", app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("user=" + app.sessionManager.GetString(r.Context(), "authenticatedUserID")))
+			})))
+			ts := newTestServer(t, app.sessionManager.LoadAndSave(mux))
+
+			// logged in without a session row, as if revoked from elsewhere
+			ts.post(t, "/test/login/user-a", nil)
+			status, body := ts.get(t, "/")
+			if status != tt.wantStatus {
+				t.Errorf("got status %d, want %d", status, tt.wantStatus)
+			}
+			if tt.wantBody != "" && body != tt.wantBody {
+				t.Errorf("got body %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/Tsundere-Musume/message/internal/migrate"
+)
+
+const migrateUsage = `usage: app migrate <command>
+
+commands:
+  up          apply every pending migration
+  down [n]    roll back the last n migrations (default 1)
+  status      list migrations and when they were applied`
+
+// runMigrate implements the migrate subcommand.
+func runMigrate(dsn string, args []string, infoLog *log.Logger) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	db, err := connectDB(dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			infoLog.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			infoLog.Println("No pending migrations")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		}
+		rolledBack, err := migrator.Down(ctx, steps)
+		for _, m := range rolledBack {
+			infoLog.Printf("Rolled back migration %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied != nil {
+				applied = s.Applied.Format("2006-01-02 15:04:05 UTC")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
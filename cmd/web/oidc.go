@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcClient logs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. The discovery document is fetched on
+// first use, and again after a failure, so the server starts even when the
+// provider is down.
+type oidcClient struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	allowed      []string // issuers whose ID tokens are accepted
+	httpClient   *http.Client
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func newOIDCClient(cfg *config, httpClient *http.Client) *oidcClient {
+	return &oidcClient{
+		issuer:       cfg.oidc.issuer,
+		clientID:     cfg.oidc.clientID,
+		clientSecret: cfg.oidc.clientSecret,
+		redirectURL:  strings.TrimSuffix(cfg.baseURL, "/") + "/user/sso/callback",
+		allowed:      cfg.oidcIssuers(),
+		httpClient:   httpClient,
+	}
+}
+
+// oidcFlow is what is remembered in the session between sending the user to
+// the provider and them coming back.
+type oidcFlow struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// oidcClaims are the parts of an ID token the app uses.
+type oidcClaims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+func (c *oidcClient) context(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, c.httpClient)
+}
+
+func (c *oidcClient) discover(ctx context.Context) (*oidc.Provider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.provider != nil {
+		return c.provider, nil
+	}
+
+	// discovery is cached for later requests, don't let one request cancel it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(c.context(ctx), c.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	c.provider = provider
+	return provider, nil
+}
+
+func (c *oidcClient) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     c.clientID,
+		ClientSecret: c.clientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  c.redirectURL,
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// start returns the url of the provider to send the user to and the flow to
+// remember until they come back.
+func (c *oidcClient) start(ctx context.Context) (string, oidcFlow, error) {
+	provider, err := c.discover(ctx)
+	if err != nil {
+		return "", oidcFlow{}, err
+	}
+
+	var flow oidcFlow
+	flow.State, err = randomString()
+	if err != nil {
+		return "", oidcFlow{}, err
+	}
+	flow.Nonce, err = randomString()
+	if err != nil {
+		return "", oidcFlow{}, err
+	}
+	flow.Verifier = oauth2.GenerateVerifier()
+
+	url := c.oauth2Config(provider).AuthCodeURL(flow.State,
+		oidc.Nonce(flow.Nonce), oauth2.S256ChallengeOption(flow.Verifier))
+	return url, flow, nil
+}
+
+var (
+	errOIDCState  = errors.New("oidc: state doesn't match")
+	errOIDCIssuer = errors.New("oidc: issuer not allowed")
+)
+
+// finish trades the code the provider sent back for an ID token and returns
+// its verified claims.
+func (c *oidcClient) finish(ctx context.Context, flow oidcFlow, state, code string) (*oidcClaims, error) {
+	if flow.State == "" || subtle.ConstantTimeCompare([]byte(flow.State), []byte(state)) != 1 {
+		return nil, errOIDCState
+	}
+	provider, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = c.context(ctx)
+	token, err := c.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("oidc exchange: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("oidc: no id_token in the token response")
+	}
+
+	// the issuer is checked against the allowed ones below, providers serving
+	// many tenants sign tokens of several issuers with the same keys
+	verifier := provider.Verifier(&oidc.Config{ClientID: c.clientID, SkipIssuerCheck: true})
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("oidc verify: %w", err)
+	}
+	if !slices.Contains(c.allowed, idToken.Issuer) {
+		return nil, fmt.Errorf("%w: %s", errOIDCIssuer, idToken.Issuer)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(flow.Nonce)) != 1 {
+		return nil, errors.New("oidc: nonce doesn't match")
+	}
+
+	var claims oidcClaims
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	mockClientID     = "message-test"
+	mockClientSecret = "secret"
+)
+
+// mockIdP is an OpenID Connect provider serving a discovery document, its
+// keys, an authorization endpoint that approves every request right away and
+// a token endpoint that checks the PKCE verifier.
+type mockIdP struct {
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// claims of the ID tokens issued from now on, iss defaults to the
+	// server url
+	claims map[string]any
+	codes  map[string]mockGrant
+}
+
+// mockGrant is what the provider remembers about a code until it is
+// exchanged.
+type mockGrant struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{
+		key:   key,
+		codes: make(map[string]mockGrant),
+		claims: map[string]any{
+			"sub":            "subject-1",
+			"email":          "alice@example.com",
+			"email_verified": true,
+			"name":           "Alice",
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+func (idp *mockIdP) setClaim(name string, value any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims[name] = value
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	base := idp.srv.URL
+	writeJSON(w, map[string]any{
+		"issuer":                                base,
+		"authorization_endpoint":                base + "/authorize",
+		"token_endpoint":                        base + "/token",
+		"jwks_uri":                              base + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := idp.key.PublicKey
+	writeJSON(w, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize approves the request and sends the user straight back with a
+// code, as if they had logged in at the provider.
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != mockClientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idp.mu.Lock()
+	idp.codes[code] = mockGrant{
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+	idp.mu.Unlock()
+
+	back, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := back.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	back.RawQuery = params.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token once, if the verifier matches the
+// challenge it was issued for.
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	grant, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || id != mockClientID || secret != mockClientSecret ||
+		r.PostForm.Get("redirect_uri") != grant.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   idp.srv.URL,
+		"aud":   mockClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": grant.nonce,
+	}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	idToken, err := idp.sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// sign returns claims as a compact RS256 JWS.
+func (idp *mockIdP) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// newTestOIDCClient returns a client of the provider, redirecting back to
+// baseURL.
+func newTestOIDCClient(t *testing.T, idp *mockIdP, baseURL string) *oidcClient {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.baseURL = baseURL
+	cfg.oidc.issuer = idp.srv.URL
+	cfg.oidc.clientID = mockClientID
+	cfg.oidc.clientSecret = mockClientSecret
+	return newOIDCClient(&cfg, idp.srv.Client())
+}
+
+// authorizeCode follows the authorization url to the provider and returns the
+// code and state it sends back.
+func authorizeCode(t *testing.T, authURL string) (string, string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got status %d", res.StatusCode)
+	}
+	back, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return back.Query().Get("code"), back.Query().Get("state")
+}
+
+func TestOIDCFinishPKCE(t *testing.T) {
+	idp := newMockIdP(t)
+	c := newTestOIDCClient(t, idp, "http://localhost:4000")
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		flow    func(oidcFlow) oidcFlow
+		state   func(string) string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:    "wrong verifier",
+			flow:    func(f oidcFlow) oidcFlow { f.Verifier = "not-the-verifier"; return f },
+			wantErr: true,
+		},
+		{
+			name:    "wrong state",
+			state:   func(s string) string { return s + "x" },
+			wantErr: true,
+		},
+		{
+			name:    "wrong nonce",
+			flow:    func(f oidcFlow) oidcFlow { f.Nonce = "not-the-nonce"; return f },
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authURL, flow, err := c.start(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, state := authorizeCode(t, authURL)
+			if tt.flow != nil {
+				flow = tt.flow(flow)
+			}
+			if tt.state != nil {
+				state = tt.state(state)
+			}
+
+			claims, err := c.finish(ctx, flow, state, code)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Issuer != idp.srv.URL || claims.Subject != "subject-1" || claims.Email != "alice@example.com" {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestOIDCFinishIssuer(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.setClaim("iss", "https://other.example.com")
+	c := newTestOIDCClient(t, idp, "http://localhost:4000")
+	ctx := context.Background()
+
+	authURL, flow, err := c.start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := authorizeCode(t, authURL)
+	_, err = c.finish(ctx, flow, state, code)
+	if !errors.Is(err, errOIDCIssuer) {
+		t.Fatalf("got error %v, want %v", err, errOIDCIssuer)
+	}
+
+	c.allowed = append(c.allowed, "https://other.example.com")
+	authURL, flow, err = c.start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state = authorizeCode(t, authURL)
+	claims, err := c.finish(ctx, flow, state, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "https://other.example.com" {
+		t.Errorf("got issuer %q", claims.Issuer)
+	}
+}
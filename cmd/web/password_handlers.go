@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Tsundere-Musume/message/internal/mailer"
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/validator"
+)
+
+// passwordResetTTL is how long a password reset link works.
+const passwordResetTTL = time.Hour
+
+func (app *application) passwordForgot(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = ForgotPasswordForm{}
+	app.render(w, http.StatusOK, "forgot_password.html", data)
+}
+
+// passwordForgotPost mails a reset link to the address if it belongs to an
+// account. The response is the same either way so the form can't be used to
+// find out who has an account.
+func (app *application) passwordForgotPost(w http.ResponseWriter, r *http.Request) {
+	var form ForgotPasswordForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Email), "email", "Email can't be empty.")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "Invalid email.")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "forgot_password.html", data)
+		return
+	}
+
+	user, err := app.users.GetByEmail(form.Email)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+	case err != nil:
+		app.serverErrror(w, err)
+		return
+	default:
+		if ok, _ := app.mailLimiter.allow(strings.ToLower(user.Email)); !ok {
+			rateLimitHits.Add("mail", 1)
+			break
+		}
+		token, err := app.passwordResets.New(user.ID.String(), passwordResetTTL)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		app.sendMail(mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. "+
+				"Open this link within an hour to choose a new one:\n\n%s\n\n"+
+				"If it wasn't you, ignore this email and your password stays the same.\n",
+				user.Name, app.link("/user/password/reset?token="+url.QueryEscape(token))),
+		})
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "If an account uses that address, we sent it a link to reset the password.")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+func (app *application) passwordReset(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	valid, err := app.passwordResets.Valid(token)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	if !valid {
+		app.sessionManager.Put(r.Context(), "flash", "That reset link is invalid or has expired, ask for a new one.")
+		http.Redirect(w, r, "/user/password/forgot", http.StatusSeeOther)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = ResetPasswordForm{Token: token}
+	app.render(w, http.StatusOK, "reset_password.html", data)
+}
+
+// passwordResetPost sets the new password and logs the user out of every
+// session, so whoever knew the old password is locked out.
+func (app *application) passwordResetPost(w http.ResponseWriter, r *http.Request) {
+	var form ResetPasswordForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Password), "password", "Password can't be empty.")
+	form.CheckField(validator.MinChars(form.Password, 8), "password", "This field must be at least 8 characters long.")
+	form.CheckField(form.Password == form.ConfirmPassword, "confirmPassword", "Passwords don't match.")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "reset_password.html", data)
+		return
+	}
+
+	userId, err := app.passwordResets.Reset(form.Token, form.Password)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidToken) {
+			app.sessionManager.Put(r.Context(), "flash", "That reset link is invalid or has expired, ask for a new one.")
+			http.Redirect(w, r, "/user/password/forgot", http.StatusSeeOther)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	err = app.revokeSessions(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	if app.sessionManager.GetString(r.Context(), "authenticatedUserID") == userId {
+		err = app.logOut(r)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your password was changed, log in with the new one.")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+	"nhooyr.io/websocket"
+)
+
+const (
+	statusOnline  = "online"
+	statusAway    = "away"
+	statusOffline = "offline"
+)
+
+var errInvalidStatus = errors.New("invalid presence status")
+
+// presencePayload is the payload of a presence event.
+type presencePayload struct {
+	UserID   string    `json:"user_id"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// statusPayload is the payload of a presence frame sent by a client when its
+// page becomes hidden or visible again.
+type statusPayload struct {
+	Status string `json:"status"`
+}
+
+// presenceTracker knows every connection of every user, no matter which room
+// it is subscribed to. A user is online if any connection is online, away if
+// all of them are away and offline without connections. Only the connections
+// to this instance are known.
+type presenceTracker struct {
+	mu      sync.Mutex
+	conns   map[string]map[*msgSubscriber]string
+	closing bool
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		conns: make(map[string]map[*msgSubscriber]string),
+	}
+}
+
+// statusLocked aggregates the status of all the connections of a user, the
+// caller must hold p.mu.
+func (p *presenceTracker) statusLocked(userId string) string {
+	conns := p.conns[userId]
+	if len(conns) == 0 {
+		return statusOffline
+	}
+	for _, status := range conns {
+		if status == statusOnline {
+			return statusOnline
+		}
+	}
+	return statusAway
+}
+
+// update applies fn to the connections of the user and reports the user
+// status afterwards and whether it changed.
+func (p *presenceTracker) update(userId string, fn func(conns map[*msgSubscriber]string)) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	before := p.statusLocked(userId)
+	conns, ok := p.conns[userId]
+	if !ok {
+		conns = make(map[*msgSubscriber]string)
+		p.conns[userId] = conns
+	}
+	fn(conns)
+	if len(conns) == 0 {
+		delete(p.conns, userId)
+	}
+	after := p.statusLocked(userId)
+	return after, before != after
+}
+
+func (p *presenceTracker) add(sub *msgSubscriber) (string, bool) {
+	return p.update(sub.userId, func(conns map[*msgSubscriber]string) {
+		// connections that race with closeAll are turned away right away
+		if p.closing {
+			sub.close(websocket.StatusGoingAway, "server shutting down")
+			return
+		}
+		conns[sub] = statusOnline
+	})
+}
+
+func (p *presenceTracker) remove(sub *msgSubscriber) (string, bool) {
+	return p.update(sub.userId, func(conns map[*msgSubscriber]string) {
+		delete(conns, sub)
+	})
+}
+
+func (p *presenceTracker) setStatus(sub *msgSubscriber, status string) (string, bool) {
+	return p.update(sub.userId, func(conns map[*msgSubscriber]string) {
+		if _, ok := conns[sub]; ok {
+			conns[sub] = status
+		}
+	})
+}
+
+func (p *presenceTracker) status(userId string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.statusLocked(userId)
+}
+
+// sendTo pushes an event to every connection of the user.
+func (p *presenceTracker) sendTo(userId string, ev event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for sub := range p.conns[userId] {
+		sub.send(ev)
+	}
+}
+
+// closeSession closes every connection opened by the session with the given
+// status.
+func (p *presenceTracker) closeSession(sessionId string, code websocket.StatusCode, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conns := range p.conns {
+		for sub := range conns {
+			if sub.sessionId == sessionId {
+				go sub.close(code, reason)
+			}
+		}
+	}
+}
+
+// closeAll closes every connection, and every connection added afterwards,
+// with the given status.
+func (p *presenceTracker) closeAll(code websocket.StatusCode, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closing = true
+	for _, conns := range p.conns {
+		for sub := range conns {
+			go sub.close(code, reason)
+		}
+	}
+}
+
+// connect registers a new connection and tells the user's friends if they just
+// came online.
+func (app *application) connect(sub *msgSubscriber) {
+	app.wg.Add(1)
+	status, changed := app.presence.add(sub)
+	if changed {
+		app.presenceChanged(sub.userId, status)
+	}
+}
+
+// disconnect is the counterpart of connect.
+func (app *application) disconnect(sub *msgSubscriber) {
+	defer app.wg.Done()
+	status, changed := app.presence.remove(sub)
+	if changed {
+		app.presenceChanged(sub.userId, status)
+	}
+}
+
+// presenceChanged records when the user was last seen and pushes the new
+// status to every friend that is connected.
+func (app *application) presenceChanged(userId, status string) {
+	now := time.Now().UTC()
+	app.background(func() {
+		err := app.users.UpdateLastSeen(userId, now)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+
+		friends, err := app.users.GetFriends(userId)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+		ev := newEvent(eventPresence, presencePayload{UserID: userId, Status: status, LastSeen: now})
+		for _, friend := range friends {
+			app.publish(userTopic(friend.ID.String()), "", ev)
+		}
+	})
+}
+
+// withPresence handles the presence frames every connection can send and
+// passes everything else on to next.
+func (app *application) withPresence(next frameHandler) frameHandler {
+	return func(ctx context.Context, sub *msgSubscriber, f clientFrame) error {
+		if f.Type != framePresence {
+			return next(ctx, sub, f)
+		}
+
+		var payload statusPayload
+		err := f.decode(&payload)
+		if err != nil {
+			return err
+		}
+		if payload.Status != statusOnline && payload.Status != statusAway {
+			return errInvalidStatus
+		}
+
+		status, changed := app.presence.setStatus(sub, payload.Status)
+		if changed {
+			app.presenceChanged(sub.userId, status)
+		}
+		return nil
+	}
+}
+
+// friendStatuses returns the current status of every user in the list keyed by
+// user id, for the templates.
+func (app *application) friendStatuses(users []*models.User) map[string]string {
+	statuses := make(map[string]string, len(users))
+	for _, user := range users {
+		statuses[user.ID.String()] = app.presence.status(user.ID.String())
+	}
+	return statuses
+}
+
+// eventsHandler opens a connection that isn't tied to any conversation, pages
+// like the friend list use it to receive presence and other account events.
+func (app *application) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusUnauthorized)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+
+	sub := newSubscriber(userId, app.sessionManager.GetString(r.Context(), "sessionID"), user.Name)
+	app.connect(sub)
+	defer app.disconnect(sub)
+
+	err = sub.serve(r.Context(), w, r, app.withPresence(func(ctx context.Context, sub *msgSubscriber, f clientFrame) error {
+		return errUnsupportedFrame
+	}))
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if websocket.CloseStatus(err) == websocket.StatusNormalClosure || websocket.CloseStatus(err) == websocket.StatusGoingAway {
+		return
+	}
+
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitHits counts the rejected messages by the limit that was hit, it is
+// served with the other expvars on /debug/vars.
+var rateLimitHits = expvar.NewMap("rate_limit_hits")
+
+// An email address gets mailBurst emails at once and another one every
+// mailInterval, so the forms sending them can't be used to flood an inbox.
+const (
+	mailBurst    = 3
+	mailInterval = 20 * time.Minute
+)
+
+// A login gets twoFactorBurst tries at the second factor and another one every
+// twoFactorInterval, far too few to guess a code.
+const (
+	twoFactorBurst    = 5
+	twoFactorInterval = time.Minute
+)
+
+// rateLimitError is returned when a message is rejected by a rate limit.
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return "too many messages, slow down"
+}
+
+// bucket is a token bucket, tokens are refilled lazily when it is used.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket for every key. A bucket holds up to burst
+// tokens and gets one back every interval, every message takes one.
+type rateLimiter struct {
+	mu        sync.Mutex
+	burst     int
+	interval  time.Duration
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time // time.Now, replaced by tests
+}
+
+func newRateLimiter(burst int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		burst:     burst,
+		interval:  interval,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// allow takes a token from the bucket of key. If there is none it reports
+// how long until there is.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+float64(now.Sub(b.last))/float64(l.interval))
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(l.interval))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refund gives back the token taken by a call to allow that was allowed.
+func (l *rateLimiter) refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(float64(l.burst), b.tokens+1)
+	}
+}
+
+// sweep drops the buckets that are full again, they behave like new ones. The
+// caller must hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	full := time.Duration(l.burst) * l.interval
+	if now.Sub(l.lastSweep) < full {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allowSend checks the limits of the sender and of the conversation, keyed by
+// its broker topic, before a message is stored. A message rejected by the
+// conversation doesn't count against the sender, a busy conversation would
+// otherwise use up their limit everywhere else.
+func (app *application) allowSend(userId, conversation string) error {
+	if ok, wait := app.userLimiter.allow(userId); !ok {
+		rateLimitHits.Add("user", 1)
+		return &rateLimitError{retryAfter: wait}
+	}
+	if ok, wait := app.conversationLimiter.allow(conversation); !ok {
+		app.userLimiter.refund(userId)
+		rateLimitHits.Add("conversation", 1)
+		return &rateLimitError{retryAfter: wait}
+	}
+	return nil
+}
+
+// rateLimited writes a 429 response telling the client when to try again if
+// err is a rate limit error and reports whether it did.
+func (app *application) rateLimited(w http.ResponseWriter, err error) bool {
+	var limitErr *rateLimitError
+	if !errors.As(err, &limitErr) {
+		return false
+	}
+	seconds := int(math.Ceil(limitErr.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	app.clientError(w, http.StatusTooManyRequests)
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns a limiter whose clock only moves when the returned
+// function is called.
+func newTestLimiter(burst int, interval time.Duration) (*rateLimiter, func(time.Duration)) {
+	l := newRateLimiter(burst, interval)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l, advance := newTestLimiter(3, time.Second)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("message %d rejected within the burst", i)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok {
+		t.Fatal("message past the burst allowed")
+	}
+	if wait != time.Second {
+		t.Errorf("got wait %v, want %v", wait, time.Second)
+	}
+
+	// other keys have buckets of their own
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("other key rejected")
+	}
+
+	advance(400 * time.Millisecond)
+	ok, wait = l.allow("a")
+	if ok {
+		t.Fatal("allowed before a token was back")
+	}
+	if wait != 600*time.Millisecond {
+		t.Errorf("got wait %v, want %v", wait, 600*time.Millisecond)
+	}
+
+	advance(600 * time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("rejected after a token was back")
+	}
+
+	// a long pause refills up to the burst, not past it
+	advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("message %d rejected after the refill", i)
+		}
+	}
+	if ok, _ := l.allow("a"); ok {
+		t.Error("refilled past the burst")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l, advance := newTestLimiter(2, time.Second)
+	l.allow("a")
+	advance(time.Second)
+	l.allow("b")
+
+	// a is full again after two intervals, b isn't yet
+	advance(time.Second)
+	l.allow("c")
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("full bucket kept")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("bucket in use dropped")
+	}
+
+	// sweeps happen at most once every burst intervals
+	advance(time.Second)
+	l.allow("c")
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("swept again too early")
+	}
+}
+
+func TestAllowSendRefund(t *testing.T) {
+	app := newTestApplication(t)
+	app.userLimiter, _ = newTestLimiter(3, time.Second)
+	app.conversationLimiter, _ = newTestLimiter(1, time.Second)
+
+	if err := app.allowSend("user-1", "dm:a:b"); err != nil {
+		t.Fatal(err)
+	}
+	// the busy conversation rejects without spending the sender's tokens
+	for i := 0; i < 5; i++ {
+		if err := app.allowSend("user-1", "dm:a:b"); err == nil {
+			t.Fatal("busy conversation allowed")
+		}
+	}
+	for _, conversation := range []string{"dm:a:c", "dm:a:d"} {
+		if err := app.allowSend("user-1", conversation); err != nil {
+			t.Fatalf("message to %s: %v", conversation, err)
+		}
+	}
+	if err := app.allowSend("user-1", "dm:a:e"); err == nil {
+		t.Error("sender limit not applied")
+	}
+}
+
+func TestRateLimitedRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{wait: 200 * time.Millisecond, want: "1"},
+		{wait: time.Second, want: "1"},
+		{wait: 1500 * time.Millisecond, want: "2"},
+		{wait: 0, want: "1"},
+	}
+
+	app := newTestApplication(t)
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		if !app.rateLimited(rr, &rateLimitError{retryAfter: tt.wait}) {
+			t.Fatal("rate limit error not handled")
+		}
+		if got := rr.Header().Get("Retry-After"); got != tt.want {
+			t.Errorf("wait %v: got Retry-After %q, want %q", tt.wait, got, tt.want)
+		}
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("got status %d", rr.Code)
+		}
+	}
+	if app.rateLimited(httptest.NewRecorder(), errFrameFailed) {
+		t.Error("other error handled as a rate limit")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -15,24 +16,77 @@ func (app *application) routes() http.Handler {
 
 	fileServer := http.FileServer(http.Dir("./ui/static"))
 	router.Handler(http.MethodGet, "/static/*filepath", http.StripPrefix("/static", fileServer))
+	uploads := http.FileServer(http.Dir(app.config.uploadDir))
+	router.Handler(http.MethodGet, "/uploads/*filepath", http.StripPrefix("/uploads", uploads))
 
-	dynamic := alice.New(app.sessionManager.LoadAndSave, noSurf, app.authenticate)
+	router.Handler(http.MethodGet, "/debug/vars", localOnly(expvar.Handler()))
+
+	dynamic := alice.New(app.sessionManager.LoadAndSave, app.noSurf, app.authenticate)
 	dynamic.ThenFunc(app.home)
 	router.Handler(http.MethodGet, "/", dynamic.ThenFunc(app.home))
 	router.Handler(http.MethodGet, "/user/signup", dynamic.ThenFunc(app.userSignUp))
 	router.Handler(http.MethodPost, "/user/signup", dynamic.ThenFunc(app.userSignUpPost))
 	router.Handler(http.MethodGet, "/user/login", dynamic.ThenFunc(app.userLogIn))
 	router.Handler(http.MethodPost, "/user/login", dynamic.ThenFunc(app.userLogInPost))
+	router.Handler(http.MethodGet, "/user/login/2fa", dynamic.ThenFunc(app.userLogInTwoFactor))
+	router.Handler(http.MethodPost, "/user/login/2fa", dynamic.ThenFunc(app.userLogInTwoFactorPost))
+	router.Handler(http.MethodGet, "/user/verify", dynamic.ThenFunc(app.verifyEmail))
+	router.Handler(http.MethodGet, "/user/password/forgot", dynamic.ThenFunc(app.passwordForgot))
+	router.Handler(http.MethodPost, "/user/password/forgot", dynamic.ThenFunc(app.passwordForgotPost))
+	router.Handler(http.MethodGet, "/user/password/reset", dynamic.ThenFunc(app.passwordReset))
+	router.Handler(http.MethodPost, "/user/password/reset", dynamic.ThenFunc(app.passwordResetPost))
 
+	if app.oidc != nil {
+		router.Handler(http.MethodGet, "/user/sso", dynamic.ThenFunc(app.ssoLogin))
+		router.Handler(http.MethodGet, "/user/sso/callback", dynamic.ThenFunc(app.ssoCallback))
+	}
 
 	protected := dynamic.Append(app.requireAuthentication)
 	router.Handler(http.MethodGet, "/message/:id", protected.ThenFunc(app.directMessage))
+	router.Handler(http.MethodGet, "/message/:id/history", protected.ThenFunc(app.directMessageHistory))
 	router.Handler(http.MethodPost, "/user/logout", protected.ThenFunc(app.userLogOutPost))
+	router.Handler(http.MethodPost, "/user/verify/resend", protected.ThenFunc(app.verifyResendPost))
 	router.Handler(http.MethodGet, "/chat", protected.ThenFunc(app.friendList))
 	router.Handler(http.MethodGet, "/subscribe/:id", protected.ThenFunc(app.subscriberHandler))
+	router.Handler(http.MethodGet, "/events", protected.ThenFunc(app.eventsHandler))
 	router.Handler(http.MethodPost, "/publish", protected.ThenFunc(app.directMessagePost))
-	router.Handler(http.MethodGet, "/user/add/:id", protected.ThenFunc(app.addFriend))
-	router.Handler(http.MethodGet, "/user/remove/:id", protected.ThenFunc(app.removeFriend))
+	router.Handler(http.MethodPost, "/messages/:id/edit", protected.ThenFunc(app.directMessageEditPost))
+	router.Handler(http.MethodPost, "/messages/:id/delete", protected.ThenFunc(app.directMessageDeletePost))
+	router.Handler(http.MethodGet, "/friends", protected.ThenFunc(app.friends))
+	router.Handler(http.MethodPost, "/user/add/:id", protected.ThenFunc(app.addFriend))
+	router.Handler(http.MethodPost, "/user/remove/:id", protected.ThenFunc(app.removeFriend))
+	router.Handler(http.MethodPost, "/user/block/:id", protected.Then(app.relationPost(app.block)))
+	router.Handler(http.MethodPost, "/user/unblock/:id", protected.Then(app.relationPost(app.policy.Unblock)))
+	router.Handler(http.MethodPost, "/user/mute/:id", protected.Then(app.relationPost(app.policy.Mute)))
+	router.Handler(http.MethodPost, "/user/unmute/:id", protected.Then(app.relationPost(app.policy.Unmute)))
+	router.Handler(http.MethodPost, "/friends/requests/:id/accept", protected.ThenFunc(app.friendRequestAcceptPost))
+	router.Handler(http.MethodPost, "/friends/requests/:id/decline", protected.ThenFunc(app.friendRequestDeclinePost))
+	router.Handler(http.MethodPost, "/friends/requests/:id/cancel", protected.ThenFunc(app.friendRequestCancelPost))
+	router.Handler(http.MethodGet, "/account/view", protected.ThenFunc(app.accountView))
+	router.Handler(http.MethodPost, "/account/privacy", protected.ThenFunc(app.accountPrivacyPost))
+	if app.oidc != nil {
+		router.Handler(http.MethodPost, "/account/sso/link", protected.ThenFunc(app.ssoLinkPost))
+		router.Handler(http.MethodPost, "/account/sso/unlink", protected.ThenFunc(app.ssoUnlinkPost))
+	}
+	router.Handler(http.MethodGet, "/account/sessions", protected.ThenFunc(app.sessionsView))
+	router.Handler(http.MethodPost, "/account/sessions/revoke/:id", protected.ThenFunc(app.sessionRevokePost))
+	router.Handler(http.MethodPost, "/account/sessions/revoke-others", protected.ThenFunc(app.sessionsRevokeOthersPost))
+	router.Handler(http.MethodGet, "/account/2fa", protected.ThenFunc(app.twoFactorView))
+	router.Handler(http.MethodGet, "/account/2fa/qr.png", protected.ThenFunc(app.twoFactorQR))
+	router.Handler(http.MethodPost, "/account/2fa/enable", protected.ThenFunc(app.twoFactorEnablePost))
+	router.Handler(http.MethodPost, "/account/2fa/disable", protected.ThenFunc(app.twoFactorDisablePost))
+	router.Handler(http.MethodGet, "/search", protected.ThenFunc(app.searchPage))
+	router.Handler(http.MethodGet, "/api/search", protected.ThenFunc(app.searchJSON))
+	router.Handler(http.MethodGet, "/users", protected.ThenFunc(app.userList))
+	router.Handler(http.MethodGet, "/api/users", protected.ThenFunc(app.userListJSON))
+	router.Handler(http.MethodGet, "/group", protected.ThenFunc(app.groupList))
+	router.Handler(http.MethodPost, "/group", protected.ThenFunc(app.groupCreatePost))
+	router.Handler(http.MethodGet, "/group/:id", protected.ThenFunc(app.groupView))
+	router.Handler(http.MethodGet, "/group/:id/history", protected.ThenFunc(app.groupHistory))
+	router.Handler(http.MethodPost, "/group/:id/members", protected.ThenFunc(app.groupAddMemberPost))
+	router.Handler(http.MethodPost, "/group/:id/members/remove", protected.ThenFunc(app.groupRemoveMemberPost))
+	router.Handler(http.MethodGet, "/group/:id/subscribe", protected.ThenFunc(app.groupSubscriberHandler))
+	router.Handler(http.MethodPost, "/group/:id/publish", protected.ThenFunc(app.groupMessagePost))
 	base := alice.New(app.logRequest, secureHeaders)
 	return base.Then(router)
 }
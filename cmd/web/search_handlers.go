@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/validator"
+)
+
+const searchPageSize = 20
+
+// searchParams reads the query and offset of a search request. It reports
+// false if they are not valid.
+func searchParams(r *http.Request) (string, int, bool) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if !validator.MaxChars(query, 200) {
+		return "", 0, false
+	}
+
+	offset := 0
+	if o := r.URL.Query().Get("offset"); o != "" {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 {
+			return "", 0, false
+		}
+		offset = n
+	}
+	return query, offset, true
+}
+
+// messageLink is the url that opens a search result in its conversation.
+func messageLink(res *models.SearchResult) string {
+	if res.Kind == models.SearchGroup {
+		return "/group/" + res.ConversationID + "?at=" + res.MessageID
+	}
+	return "/message/" + res.ConversationID + "?at=" + res.MessageID
+}
+
+func (app *application) searchPage(w http.ResponseWriter, r *http.Request) {
+	query, offset, ok := searchParams(r)
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Query = query
+	if query != "" {
+		userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+		results, err := app.search.Search(userId, query, searchPageSize+1, offset)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		if len(results) > searchPageSize {
+			results = results[:searchPageSize]
+			data.NextOffset = offset + searchPageSize
+		}
+		data.Results = results
+	}
+	app.render(w, http.StatusOK, "search.html", data)
+}
+
+func (app *application) searchJSON(w http.ResponseWriter, r *http.Request) {
+	query, offset, ok := searchParams(r)
+	if !ok || query == "" {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	results, err := app.search.Search(userId, query, searchPageSize+1, offset)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	next := 0
+	if len(results) > searchPageSize {
+		results = results[:searchPageSize]
+		next = offset + searchPageSize
+	}
+
+	type result struct {
+		*models.SearchResult
+		Snippet string `json:"snippet"` // html with the matches in <mark>
+		URL     string `json:"url"`
+	}
+	out := make([]result, 0, len(results))
+	for _, res := range results {
+		out = append(out, result{
+			SearchResult: res,
+			Snippet:      string(highlight(res.Snippet)),
+			URL:          messageLink(res),
+		})
+	}
+
+	app.writeJSON(w, http.StatusOK, map[string]any{
+		"results":     out,
+		"next_offset": next,
+	})
+}
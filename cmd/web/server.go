@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// serve runs the server until it fails or the process receives SIGINT or
+// SIGTERM. On a signal it stops accepting connections, tells every websocket
+// subscriber the server is going away and waits for the running handlers and
+// background work, at most for the configured shutdown timeout.
+//
+// With a certificate configured it serves HTTPS and, if a redirect address is
+// set, redirects plain HTTP requests from there.
+func (app *application) serve(srv *http.Server) error {
+	var redirect *http.Server
+	if app.config.tlsEnabled() {
+		cr, err := newCertReloader(app.config.tlsCert, app.config.tlsKey, app.infoLog, app.errorLog)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go cr.watch(ctx)
+		srv.TLSConfig = newTLSConfig(cr)
+
+		if app.config.redirectAddr != "" {
+			redirect = &http.Server{
+				Addr:         app.config.redirectAddr,
+				Handler:      redirectHTTPS(srv.Addr),
+				ErrorLog:     app.errorLog,
+				IdleTimeout:  time.Minute,
+				ReadTimeout:  5 * time.Second,
+				WriteTimeout: 5 * time.Second,
+			}
+		}
+	}
+
+	srv.RegisterOnShutdown(func() {
+		app.presence.closeAll(websocket.StatusGoingAway, "server shutting down")
+	})
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.infoLog.Printf("Shutting down server, received %s", s)
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		// Shutdown doesn't wait for hijacked connections, the websocket
+		// handlers are tracked by app.wg instead. Every step runs even if an
+		// earlier one failed, and the first error is reported.
+		err := srv.Shutdown(ctx)
+		if redirect != nil {
+			if redirectErr := redirect.Shutdown(ctx); err == nil {
+				err = redirectErr
+			}
+		}
+		if waitErr := app.wait(ctx); err == nil {
+			err = waitErr
+		}
+		shutdownErr <- err
+	}()
+
+	if redirect != nil {
+		go func() {
+			app.infoLog.Printf("Redirecting HTTP on %v", redirect.Addr)
+			err := redirect.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.errorLog.Printf("Redirect server: %s", err)
+			}
+		}()
+	}
+
+	var err error
+	if app.config.tlsEnabled() {
+		app.infoLog.Printf("Started HTTPS server on %v", srv.Addr)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		app.infoLog.Printf("Started server on %v", srv.Addr)
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownErr
+	if err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	app.infoLog.Println("Stopped server")
+	return nil
+}
+
+// background runs fn in a goroutine the shutdown waits for.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+		defer func() {
+			if err := recover(); err != nil {
+				app.errorLog.Println(err)
+			}
+		}()
+		fn()
+	}()
+}
+
+// wait blocks until every websocket handler and background goroutine returned
+// or the context is done.
+func (app *application) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
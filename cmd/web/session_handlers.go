@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/validator"
+	"github.com/julienschmidt/httprouter"
+	"nhooyr.io/websocket"
+)
+
+// statusSessionRevoked closes the connections of a session that was logged
+// out, clients go back to the login page instead of reconnecting.
+const statusSessionRevoked websocket.StatusCode = 4001
+
+// clientIP is the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// logIn finishes logging userId in once every factor was checked. The session
+// gets a new token and is recorded so it can be listed and revoked.
+func (app *application) logIn(r *http.Request, userId string) error {
+	ctx := r.Context()
+	if old := app.sessionManager.GetString(ctx, "sessionID"); old != "" {
+		app.endSession(old, app.sessionManager.GetString(ctx, "authenticatedUserID"))
+	}
+
+	err := app.sessionManager.RenewToken(ctx)
+	if err != nil {
+		return err
+	}
+	sessionId, err := app.sessions.Create(userId, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return err
+	}
+	app.sessionManager.Remove(ctx, "twoFactorUserID")
+	app.sessionManager.Remove(ctx, "twoFactorStarted")
+	app.sessionManager.Put(ctx, "authenticatedUserID", userId)
+	app.sessionManager.Put(ctx, "sessionID", sessionId)
+	return nil
+}
+
+// logOut forgets who is logged in to the session of r, the session itself
+// keeps going for things like flash messages.
+func (app *application) logOut(r *http.Request) error {
+	ctx := r.Context()
+	app.endSession(app.sessionManager.GetString(ctx, "sessionID"), app.sessionManager.GetString(ctx, "authenticatedUserID"))
+
+	err := app.sessionManager.RenewToken(ctx)
+	if err != nil {
+		return err
+	}
+	app.sessionManager.Remove(ctx, "authenticatedUserID")
+	app.sessionManager.Remove(ctx, "sessionID")
+	return nil
+}
+
+// endSession revokes a session of userId and closes its connections, failures
+// are only logged since the session is being left anyway.
+func (app *application) endSession(sessionId, userId string) {
+	if sessionId == "" || userId == "" {
+		return
+	}
+	err := app.sessions.Revoke(sessionId, userId)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.errorLog.Println(err)
+		return
+	}
+	app.closeSession(sessionId)
+}
+
+// revokeSessions logs userId out of every session but the ones in keep, on
+// every instance.
+func (app *application) revokeSessions(userId string, keep ...string) error {
+	ids, err := app.sessions.RevokeAll(userId, keep...)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		app.closeSession(id)
+	}
+	return nil
+}
+
+// closeSession closes the connections of a revoked session, wherever they
+// are. Nothing is sent over them first so the event is left empty.
+func (app *application) closeSession(sessionId string) {
+	app.publish(sessionTopic(sessionId), "", event{})
+}
+
+// sessionsView lists the browsers the user is logged in with.
+func (app *application) sessionsView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	sessions, err := app.sessions.Sessions(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Sessions = sessions
+	data.SessionID = app.sessionManager.GetString(r.Context(), "sessionID")
+	app.render(w, http.StatusOK, "sessions.html", data)
+}
+
+// sessionRevokePost logs the user out of one session, revoking the current
+// one is the same as logging out.
+func (app *application) sessionRevokePost(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	params := httprouter.ParamsFromContext(r.Context())
+	sessionId := params.ByName("id")
+	if !validator.IsUUID(sessionId) {
+		app.notFound(w)
+		return
+	}
+
+	if sessionId == app.sessionManager.GetString(r.Context(), "sessionID") {
+		err := app.logOut(r)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err := app.sessions.Revoke(sessionId, userId)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+	app.closeSession(sessionId)
+
+	app.sessionManager.Put(r.Context(), "flash", "The session was logged out.")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+// sessionsRevokeOthersPost logs the user out everywhere but here.
+func (app *application) sessionsRevokeOthersPost(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	err := app.revokeSessions(userId, app.sessionManager.GetString(r.Context(), "sessionID"))
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Every other session was logged out.")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/validator"
+)
+
+// startSSO sends the user to the identity provider. linkUserId is set when a
+// logged in user links the provider account to theirs instead of logging in.
+func (app *application) startSSO(w http.ResponseWriter, r *http.Request, linkUserId string) {
+	url, flow, err := app.oidc.start(r.Context())
+	if err != nil {
+		app.errorLog.Println(err)
+		app.sessionManager.Put(r.Context(), "flash", "Single sign-on is unavailable right now, try again later.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "oidcState", flow.State)
+	app.sessionManager.Put(r.Context(), "oidcNonce", flow.Nonce)
+	app.sessionManager.Put(r.Context(), "oidcVerifier", flow.Verifier)
+	app.sessionManager.Put(r.Context(), "oidcLinkUserID", linkUserId)
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
+
+func (app *application) ssoLogin(w http.ResponseWriter, r *http.Request) {
+	app.startSSO(w, r, "")
+}
+
+func (app *application) ssoLinkPost(w http.ResponseWriter, r *http.Request) {
+	app.startSSO(w, r, app.sessionManager.GetString(r.Context(), "authenticatedUserID"))
+}
+
+// ssoCallback is where the identity provider sends the user back to. The
+// provider account is linked to a user by its issuer and subject, a user is
+// created for it on the first login if that is allowed. Users that turned two
+// factor authentication on still enter their code after the provider.
+func (app *application) ssoCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	flow := oidcFlow{
+		State:    app.sessionManager.PopString(ctx, "oidcState"),
+		Nonce:    app.sessionManager.PopString(ctx, "oidcNonce"),
+		Verifier: app.sessionManager.PopString(ctx, "oidcVerifier"),
+	}
+	linkUserId := app.sessionManager.PopString(ctx, "oidcLinkUserID")
+
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		app.infoLog.Printf("Single sign-on: %s: %s", query.Get("error"), query.Get("error_description"))
+		app.sessionManager.Put(ctx, "flash", "Single sign-on was cancelled.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	claims, err := app.oidc.finish(ctx, flow, query.Get("state"), query.Get("code"))
+	if err != nil {
+		if errors.Is(err, errOIDCState) {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+		app.errorLog.Printf("Single sign-on: %s", err)
+		app.sessionManager.Put(ctx, "flash", "Single sign-on failed, try again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	identity := models.Identity{Issuer: claims.Issuer, Subject: claims.Subject, Email: claims.Email}
+
+	if linkUserId != "" && linkUserId == app.sessionManager.GetString(ctx, "authenticatedUserID") {
+		err = app.identities.Link(linkUserId, identity)
+		switch {
+		case errors.Is(err, models.ErrIdentityTaken):
+			app.sessionManager.Put(ctx, "flash", "That single sign-on account is linked to someone else.")
+		case err != nil:
+			app.serverErrror(w, err)
+			return
+		default:
+			app.sessionManager.Put(ctx, "flash", "Single sign-on is linked to your account.")
+		}
+		http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+		return
+	}
+
+	userId, err := app.identities.UserID(identity.Issuer, identity.Subject)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		userId, err = app.createSSOUser(claims, identity)
+		if err != nil {
+			if !errors.Is(err, models.ErrDuplicateEmail) && !errors.Is(err, errNoSSOAccount) {
+				app.serverErrror(w, err)
+				return
+			}
+			app.sessionManager.Put(ctx, "flash", "No account uses this single sign-on yet. Log in with your password and link it on your account page.")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+	case err != nil:
+		app.serverErrror(w, err)
+		return
+	}
+
+	twoFactor, err := app.startTwoFactor(r, userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	if twoFactor {
+		http.Redirect(w, r, "/user/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	err = app.logIn(r, userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+var errNoSSOAccount = errors.New("no account for single sign-on")
+
+// createSSOUser creates the account of someone logging in with the provider
+// for the first time, if the config allows it and the provider sent a usable
+// email address.
+func (app *application) createSSOUser(claims *oidcClaims, identity models.Identity) (string, error) {
+	if !app.config.oidc.createUsers || !validator.Matches(claims.Email, validator.EmailRX) {
+		return "", errNoSSOAccount
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.PreferredUsername
+	}
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	id, err := app.identities.CreateUser(name, identity, claims.EmailVerified)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+func (app *application) ssoUnlinkPost(w http.ResponseWriter, r *http.Request) {
+	var form IdentityForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	err = app.identities.Unlink(userId, form.Issuer, form.Subject)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverErrror(w, err)
+		}
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Single sign-on is unlinked from your account.")
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newSSOTestServer serves the single sign-on handlers of app against idp.
+// Every other path reports who is logged in and the flash message, which is
+// where the handlers redirect to once they are done.
+func newSSOTestServer(t *testing.T, app *application, idp *mockIdP) *testServer {
+	t.Helper()
+	mux := http.NewServeMux()
+	ts := newTestServer(t, app.sessionManager.LoadAndSave(mux))
+	app.config.baseURL = ts.URL
+	app.oidc = newTestOIDCClient(t, idp, ts.URL)
+
+	mux.HandleFunc("GET /user/sso", app.ssoLogin)
+	mux.HandleFunc("GET /user/sso/callback", app.ssoCallback)
+	mux.HandleFunc("POST /account/sso/link", app.ssoLinkPost)
+	mux.HandleFunc("POST /account/sso/unlink", app.ssoUnlinkPost)
+	mux.HandleFunc("POST /test/login/{id}", func(w http.ResponseWriter, r *http.Request) {
+		app.sessionManager.Put(r.Context(), "authenticatedUserID", r.PathValue("id"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "user=%s\nflash=%s",
+			app.sessionManager.GetString(r.Context(), "authenticatedUserID"),
+			app.sessionManager.PopString(r.Context(), "flash"))
+	})
+	return ts
+}
+
+// whoami splits the body of the catch all page.
+func whoami(t *testing.T, body string) (string, string) {
+	t.Helper()
+	user, flash, ok := strings.Cut(body, "\n")
+	if !ok {
+		t.Fatalf("unexpected page %q", body)
+	}
+	return strings.TrimPrefix(user, "user="), strings.TrimPrefix(flash, "flash=")
+}
+
+func TestSSOLoginLinkedIdentity(t *testing.T) {
+	app := newTestApplication(t)
+	idp := newMockIdP(t)
+	ts := newSSOTestServer(t, app, idp)
+
+	identities := app.identities.(*fakeIdentities)
+	identities.linked[[2]string{idp.srv.URL, "subject-1"}] = "user-a"
+
+	status, body := ts.get(t, "/user/sso")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	user, _ := whoami(t, body)
+	if user != "user-a" {
+		t.Errorf("logged in as %q, want user-a", user)
+	}
+	if len(identities.created) != 0 {
+		t.Errorf("created users %v", identities.created)
+	}
+	if sessions, _ := app.sessions.Sessions("user-a"); len(sessions) != 1 {
+		t.Errorf("got %d sessions, want 1", len(sessions))
+	}
+}
+
+func TestSSOLoginTwoFactor(t *testing.T) {
+	app := newTestApplication(t)
+	idp := newMockIdP(t)
+	ts := newSSOTestServer(t, app, idp)
+
+	app.identities.(*fakeIdentities).linked[[2]string{idp.srv.URL, "subject-1"}] = "user-a"
+	app.twoFactor.Enable("user-a", nil, 0)
+
+	res, err := ts.client.Get(ts.URL + "/user/sso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body := readResponse(t, res)
+	if res.Request.URL.Path != "/user/login/2fa" {
+		t.Errorf("ended up on %s, want the two factor step", res.Request.URL.Path)
+	}
+	if user, _ := whoami(t, body); user != "" {
+		t.Errorf("logged in as %q before the second factor", user)
+	}
+	if sessions, _ := app.sessions.Sessions("user-a"); len(sessions) != 0 {
+		t.Errorf("got %d sessions, want none", len(sessions))
+	}
+}
+
+func TestSSOLoginFirstTime(t *testing.T) {
+	tests := []struct {
+		name        string
+		createUsers bool
+		wantCreated bool
+		wantFlash   string
+	}{
+		{
+			name:        "creates and links a user",
+			createUsers: true,
+			wantCreated: true,
+		},
+		{
+			name:        "refused without auto-create",
+			createUsers: false,
+			wantFlash:   "No account uses this single sign-on yet.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.oidc.createUsers = tt.createUsers
+			idp := newMockIdP(t)
+			ts := newSSOTestServer(t, app, idp)
+			identities := app.identities.(*fakeIdentities)
+
+			_, body := ts.get(t, "/user/sso")
+			user, flash := whoami(t, body)
+			if !strings.HasPrefix(flash, tt.wantFlash) {
+				t.Errorf("got flash %q, want %q", flash, tt.wantFlash)
+			}
+
+			if !tt.wantCreated {
+				if user != "" || len(identities.created) != 0 || len(identities.linked) != 0 {
+					t.Errorf("logged in as %q, created %v, linked %v", user, identities.created, identities.linked)
+				}
+				return
+			}
+			if len(identities.created) != 1 {
+				t.Fatalf("created users %v, want one", identities.created)
+			}
+			if user != identities.created[0] {
+				t.Errorf("logged in as %q, want the created user %q", user, identities.created[0])
+			}
+			if linked, _ := identities.UserID(idp.srv.URL, "subject-1"); linked != user {
+				t.Errorf("identity linked to %q, want %q", linked, user)
+			}
+		})
+	}
+}
+
+func TestSSOLoginIssuerNotAllowed(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.oidc.createUsers = true
+	idp := newMockIdP(t)
+	idp.setClaim("iss", "https://other.example.com")
+	ts := newSSOTestServer(t, app, idp)
+	identities := app.identities.(*fakeIdentities)
+	identities.linked[[2]string{"https://other.example.com", "subject-1"}] = "user-a"
+
+	_, body := ts.get(t, "/user/sso")
+	user, flash := whoami(t, body)
+	if user != "" {
+		t.Errorf("logged in as %q", user)
+	}
+	if flash != "Single sign-on failed, try again." {
+		t.Errorf("got flash %q", flash)
+	}
+	if len(identities.created) != 0 {
+		t.Errorf("created users %v", identities.created)
+	}
+}
+
+func TestSSOLink(t *testing.T) {
+	app := newTestApplication(t)
+	idp := newMockIdP(t)
+	ts := newSSOTestServer(t, app, idp)
+	identities := app.identities.(*fakeIdentities)
+
+	ts.post(t, "/test/login/user-b", nil)
+	_, body := ts.post(t, "/account/sso/link", nil)
+	if _, flash := whoami(t, body); flash != "Single sign-on is linked to your account." {
+		t.Errorf("got flash %q", flash)
+	}
+	if linked, _ := identities.UserID(idp.srv.URL, "subject-1"); linked != "user-b" {
+		t.Errorf("identity linked to %q, want user-b", linked)
+	}
+
+	// someone else can't take it over
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &testServer{Server: ts.Server, client: &http.Client{Jar: jar}}
+	other.post(t, "/test/login/user-c", nil)
+	_, body = other.post(t, "/account/sso/link", nil)
+	if _, flash := whoami(t, body); flash != "That single sign-on account is linked to someone else." {
+		t.Errorf("got flash %q", flash)
+	}
+	if linked, _ := identities.UserID(idp.srv.URL, "subject-1"); linked != "user-b" {
+		t.Errorf("identity linked to %q, want user-b", linked)
+	}
+}
+
+func TestSSOUnlink(t *testing.T) {
+	app := newTestApplication(t)
+	idp := newMockIdP(t)
+	ts := newSSOTestServer(t, app, idp)
+	identities := app.identities.(*fakeIdentities)
+	identities.linked[[2]string{idp.srv.URL, "subject-1"}] = "user-b"
+
+	ts.post(t, "/test/login/user-c", nil)
+	form := url.Values{"issuer": {idp.srv.URL}, "subject": {"subject-1"}}
+	if status, _ := ts.post(t, "/account/sso/unlink", form); status != http.StatusNotFound {
+		t.Errorf("unlinking someone else's identity: got status %d, want %d", status, http.StatusNotFound)
+	}
+	if _, ok := identities.linked[[2]string{idp.srv.URL, "subject-1"}]; !ok {
+		t.Error("someone else's identity unlinked")
+	}
+
+	ts.post(t, "/test/login/user-b", nil)
+	_, body := ts.post(t, "/account/sso/unlink", form)
+	if _, flash := whoami(t, body); flash != "Single sign-on is unlinked from your account." {
+		t.Errorf("got flash %q", flash)
+	}
+	if status, _ := ts.post(t, "/account/sso/unlink", form); status != http.StatusNotFound {
+		t.Errorf("unlinking twice: got status %d, want %d", status, http.StatusNotFound)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"html/template"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/Tsundere-Musume/message/internal/models"
@@ -14,9 +15,41 @@ type templateData struct {
 	User            *models.User
 	Users           []*models.User
 	Messages        []*models.DirectMessage // TODO: change it to a more generic message type later or add two separate messages for direct message or group message
+	GroupMessages   []*models.GroupMessage
+	Group           *models.Group
+	Groups          []*models.Group
+	Members         []*models.User
+	Conversations   []*models.Conversation
 	IsAuthenticated bool
+	Unverified      bool // the user hasn't verified their email address yet
+	Flash           string
 	CSRFToken       string
 	Heading         string
+	ReceiverID      string
+	Presence        map[string]string // user id to online status
+	Unread          map[string]int    // user id to number of unread messages
+	SeenID          string            // last message the other user has read
+	FocusID         string            // message to scroll to when the page opens
+	HasNewer        bool              // messages after the rendered ones weren't loaded
+	CanMessage      bool              // the policy lets the user write to the receiver
+	IsBlocked       bool              // the user blocked the receiver
+	IsMuted         bool              // the user muted the receiver
+	Incoming        []*models.FriendRequest
+	Outgoing        []*models.FriendRequest
+	TwoFactor       bool     // the user logs in with a second factor
+	TOTPSecret      string   // secret to enter by hand while enabling two factor
+	RecoveryCodes   []string // shown once after two factor is enabled
+	RecoveryLeft    int      // unused recovery codes
+	SSO             bool     // single sign-on is configured
+	Identities      []*models.Identity
+	Sessions        []*models.Session
+	SessionID       string         // the session the page is rendered for
+	Blocked         []*models.User // users the user blocked
+	RequestCount    int            // pending friend requests sent to the user
+	Query           string
+	Directory       []*models.DirectoryEntry
+	Results         []*models.SearchResult
+	NextOffset      int
 }
 
 func chatTime(t time.Time, timezone string) string {
@@ -33,8 +66,86 @@ func chatTime(t time.Time, timezone string) string {
 	return t.In(loc).Format("03:04:05 PM")
 }
 
+// lastSeen formats the last time a user was connected.
+func lastSeen(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format("02 Jan 2006 15:04 UTC")
+}
+
+// device names the browser and system of a user agent for the session list,
+// good enough to tell one's own devices apart.
+func device(userAgent string) string {
+	browser := "Unknown browser"
+	for _, b := range [][2]string{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b[0]) {
+			browser = b[1]
+			break
+		}
+	}
+	for _, s := range [][2]string{
+		{"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iOS"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, s[0]) {
+			return browser + " on " + s[1]
+		}
+	}
+	return browser
+}
+
+// statusClass maps a presence status to the color of its status dot.
+func statusClass(status string) string {
+	switch status {
+	case statusOnline:
+		return "bg-foam"
+	case statusAway:
+		return "bg-gold"
+	default:
+		return "bg-muted"
+	}
+}
+
+// highlight escapes a search snippet and turns the match markers into <mark>
+// tags. Markers that don't open or close a highlight, which older messages
+// may contain, are dropped so the tags always balance.
+func highlight(snippet string) template.HTML {
+	escaped := template.HTMLEscapeString(snippet)
+	var b strings.Builder
+	open := false
+	for _, r := range escaped {
+		switch string(r) {
+		case models.HighlightStart:
+			if !open {
+				b.WriteString("<mark>")
+				open = true
+			}
+		case models.HighlightStop:
+			if open {
+				b.WriteString("</mark>")
+				open = false
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if open {
+		b.WriteString("</mark>")
+	}
+	return template.HTML(b.String())
+}
+
 var functions = template.FuncMap{
-	"chatTime": chatTime,
+	"highlight":   highlight,
+	"messageLink": messageLink,
+	"chatTime":    chatTime,
+	"lastSeen":    lastSeen,
+	"device":      device,
+	"statusClass": statusClass,
 }
 
 func newTemplateCache() (map[string]*template.Template, error) {
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name    string
+		snippet string
+		want    string
+	}{
+		{
+			name:    "match",
+			snippet: "say \x02hello\x03 there",
+			want:    "say <mark>hello</mark> there",
+		},
+		{
+			name:    "escaped",
+			snippet: "<b>\x02hi\x03</b>",
+			want:    "&lt;b&gt;<mark>hi</mark>&lt;/b&gt;",
+		},
+		{
+			name:    "stray stop",
+			snippet: "a\x03 \x02b\x03",
+			want:    "a <mark>b</mark>",
+		},
+		{
+			name:    "unclosed start",
+			snippet: "\x02a\x02 b",
+			want:    "<mark>a b</mark>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(highlight(tt.snippet)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMessageBodyControlCharacters(t *testing.T) {
+	got, err := validateMessageBody(" \x02hi\x03\tthere\nfriend\x00 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hi\tthere\nfriend"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = validateMessageBody("\x02\x03")
+	if err != errEmptyMessage {
+		t.Errorf("got error %v, want %v", err, errEmptyMessage)
+	}
+}
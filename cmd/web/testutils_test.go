@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-playground/form/v4"
+	"github.com/google/uuid"
+	"nhooyr.io/websocket"
+)
+
+// fakeIdentities keeps identities in memory.
+type fakeIdentities struct {
+	mu      sync.Mutex
+	linked  map[[2]string]string // issuer and subject to user id
+	created []string             // users created by CreateUser
+}
+
+func newFakeIdentities() *fakeIdentities {
+	return &fakeIdentities{linked: make(map[[2]string]string)}
+}
+
+func (f *fakeIdentities) UserID(issuer, subject string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	userId, ok := f.linked[[2]string{issuer, subject}]
+	if !ok {
+		return "", models.ErrNoRecord
+	}
+	return userId, nil
+}
+
+func (f *fakeIdentities) Link(userId string, identity models.Identity) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := [2]string{identity.Issuer, identity.Subject}
+	if owner, ok := f.linked[key]; ok && owner != userId {
+		return models.ErrIdentityTaken
+	}
+	f.linked[key] = userId
+	return nil
+}
+
+func (f *fakeIdentities) Unlink(userId, issuer, subject string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := [2]string{issuer, subject}
+	if owner, ok := f.linked[key]; !ok || owner != userId {
+		return models.ErrNoRecord
+	}
+	delete(f.linked, key)
+	return nil
+}
+
+func (f *fakeIdentities) Identities(userId string) ([]*models.Identity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	identities := []*models.Identity{}
+	for key, owner := range f.linked {
+		if owner == userId {
+			identities = append(identities, &models.Identity{Issuer: key[0], Subject: key[1], UserID: owner})
+		}
+	}
+	return identities, nil
+}
+
+func (f *fakeIdentities) CreateUser(name string, identity models.Identity, emailVerified bool) (uuid.UUID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := uuid.New()
+	f.created = append(f.created, id.String())
+	f.linked[[2]string{identity.Issuer, identity.Subject}] = id.String()
+	return id, nil
+}
+
+// fakeSessions keeps the session table in memory.
+type fakeSessions struct {
+	mu       sync.Mutex
+	sessions map[string]string // session id to user id
+}
+
+func newFakeSessions() *fakeSessions {
+	return &fakeSessions{sessions: make(map[string]string)}
+}
+
+func (f *fakeSessions) Create(userId, userAgent, ip string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := uuid.NewString()
+	f.sessions[id] = userId
+	return id, nil
+}
+
+func (f *fakeSessions) Touch(id, userId, ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sessions[id] != userId || userId == "" {
+		return models.ErrNoRecord
+	}
+	return nil
+}
+
+func (f *fakeSessions) Sessions(userId string) ([]*models.Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sessions := []*models.Session{}
+	for id, owner := range f.sessions {
+		if owner == userId {
+			sessions = append(sessions, &models.Session{ID: uuid.MustParse(id), UserID: owner})
+		}
+	}
+	return sessions, nil
+}
+
+func (f *fakeSessions) Revoke(id, userId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sessions[id] != userId {
+		return models.ErrNoRecord
+	}
+	delete(f.sessions, id)
+	return nil
+}
+
+func (f *fakeSessions) RevokeAll(userId string, keep ...string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := []string{}
+	for id, owner := range f.sessions {
+		if owner == userId && !slices.Contains(keep, id) {
+			delete(f.sessions, id)
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// fakeTwoFactor knows who turned two factor authentication on, none of their
+// codes are right.
+type fakeTwoFactor struct {
+	mu      sync.Mutex
+	enabled map[string]bool
+}
+
+func newFakeTwoFactor() *fakeTwoFactor {
+	return &fakeTwoFactor{enabled: make(map[string]bool)}
+}
+
+func (f *fakeTwoFactor) Enabled(userId string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enabled[userId], nil
+}
+
+func (f *fakeTwoFactor) Enable(userId string, secret []byte, step int64) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.enabled[userId] = true
+	return []string{}, nil
+}
+
+func (f *fakeTwoFactor) Disable(userId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.enabled, userId)
+	return nil
+}
+
+func (f *fakeTwoFactor) Check(userId, code string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled[userId] {
+		return false, models.ErrNoRecord
+	}
+	return false, nil
+}
+
+func (f *fakeTwoFactor) RecoveryCodesLeft(userId string) (int, error) {
+	return 0, nil
+}
+
+// newTestApplication returns an application with in memory sessions and
+// fake models, enough for handlers that don't reach the database.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+	cfg := defaultConfig()
+	app := &application{
+		config:         &cfg,
+		errorLog:       log.New(io.Discard, "", 0),
+		infoLog:        log.New(io.Discard, "", 0),
+		sessionManager: scs.New(),
+		formDecoder:    form.NewDecoder(),
+		identities:     newFakeIdentities(),
+		sessions:       newFakeSessions(),
+		twoFactor:      newFakeTwoFactor(),
+		presence:       newPresenceTracker(),
+	}
+	app.broker = &memoryBroker{deliver: app.deliver}
+	return app
+}
+
+// testServer is an httptest.Server with a client that keeps cookies.
+type testServer struct {
+	*httptest.Server
+	client *http.Client
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ts.Client()
+	client.Jar = jar
+	return &testServer{Server: ts, client: client}
+}
+
+// get requests path and returns the status and body of the response, after
+// following redirects.
+func (ts *testServer) get(t *testing.T, path string) (int, string) {
+	t.Helper()
+	res, err := ts.client.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, res)
+}
+
+// post is get for form posts.
+func (ts *testServer) post(t *testing.T, path string, form url.Values) (int, string) {
+	t.Helper()
+	res, err := ts.client.PostForm(ts.URL+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, res)
+}
+
+func readResponse(t *testing.T, res *http.Response) (int, string) {
+	t.Helper()
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, strings.TrimSpace(string(body))
+}
+
+// dialRoom serves subscribe over a websocket server, connects one client for
+// each of userIds and waits until subscribers reports all of them joined. The
+// returned context bounds the test.
+func dialRoom(t *testing.T, subscribe func(context.Context, http.ResponseWriter, *http.Request, *msgSubscriber, frameHandler) error, subscribers func() int, userIds ...string) (context.Context, []*websocket.Conn) {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub := newSubscriber(r.URL.Query().Get("user"), "", "name")
+		subscribe(r.Context(), w, r, sub, func(ctx context.Context, sub *msgSubscriber, f clientFrame) error {
+			return nil
+		})
+	}))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	var conns []*websocket.Conn
+	for _, userId := range userIds {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/?user=" + userId
+		c, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{Subprotocols: subprotocols})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.CloseNow() })
+		conns = append(conns, c)
+	}
+
+	for subscribers() != len(userIds) {
+		if ctx.Err() != nil {
+			t.Fatal("subscribers never joined")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ctx, conns
+}
+
+// assertClosed reads from c and fails unless the server closed it with status.
+func assertClosed(t *testing.T, ctx context.Context, c *websocket.Conn, status websocket.StatusCode) {
+	t.Helper()
+	_, _, err := c.Read(ctx)
+	if got := websocket.CloseStatus(err); got != status {
+		t.Errorf("got close status %v (%v), want %v", got, err, status)
+	}
+}
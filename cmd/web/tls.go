@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often the certificate files are checked for
+// changes.
+const certReloadInterval = time.Minute
+
+// certReloader serves the certificate from certFile and keyFile and loads it
+// again when either file changes, so renewed certificates are picked up
+// without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	errorLog *log.Logger
+	infoLog  *log.Logger
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func newCertReloader(certFile, keyFile string, infoLog, errorLog *log.Logger) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		errorLog: errorLog,
+		infoLog:  infoLog,
+	}
+	modified, err := cr.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	err = cr.load(modified)
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// lastModified returns the latest modification time of the two files.
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) load(modified time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modified = modified
+	return nil
+}
+
+// watch reloads the certificate whenever the files change until ctx is done.
+// A certificate that fails to load is logged and the previous one is kept.
+func (cr *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modified, err := cr.lastModified()
+		if err != nil {
+			cr.errorLog.Println(err)
+			continue
+		}
+		cr.mu.RLock()
+		changed := modified.After(cr.modified)
+		cr.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		err = cr.load(modified)
+		if err != nil {
+			cr.errorLog.Printf("Keeping the current certificate: %s", err)
+			continue
+		}
+		cr.infoLog.Printf("Reloaded certificate %s", cr.certFile)
+	}
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// newTLSConfig only allows TLS 1.2 and newer with forward secret AEAD cipher
+// suites, TLS 1.3 suites are not configurable and secure already.
+func newTLSConfig(cr *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		GetCertificate: cr.getCertificate,
+	}
+}
+
+// redirectHTTPS sends every plain HTTP request to the same url on the HTTPS
+// address.
+func redirectHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		target := strings.TrimSuffix(net.JoinHostPort(host, port), ":443")
+
+		// only GET and HEAD are safe to repeat on another scheme
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+target+r.URL.RequestURI(), status)
+	})
+}
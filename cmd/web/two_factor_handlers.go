@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/totp"
+	"github.com/Tsundere-Musume/message/internal/validator"
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+)
+
+// twoFactorLoginTTL is how long after the password the code can be entered.
+const twoFactorLoginTTL = 5 * time.Minute
+
+// totpIssuer names the account in authenticator apps.
+const totpIssuer = "Message"
+
+// pendingTwoFactor returns the user that entered their password but not their
+// code yet, if that wasn't too long ago.
+func (app *application) pendingTwoFactor(r *http.Request) (string, bool) {
+	userId := app.sessionManager.GetString(r.Context(), "twoFactorUserID")
+	started := time.Unix(app.sessionManager.GetInt64(r.Context(), "twoFactorStarted"), 0)
+	if userId == "" || time.Since(started) > twoFactorLoginTTL {
+		return "", false
+	}
+	return userId, true
+}
+
+// startTwoFactor starts the second step of the login if userId turned two
+// factor authentication on and reports whether it did. The session only
+// remembers the first factor was right until the code is entered.
+func (app *application) startTwoFactor(r *http.Request, userId string) (bool, error) {
+	enabled, err := app.twoFactor.Enabled(userId)
+	if err != nil || !enabled {
+		return false, err
+	}
+	app.sessionManager.Put(r.Context(), "twoFactorUserID", userId)
+	app.sessionManager.Put(r.Context(), "twoFactorStarted", time.Now().Unix())
+	return true, nil
+}
+
+func (app *application) userLogInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.pendingTwoFactor(r); !ok {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+	data := app.newTemplateData(r)
+	data.Form = TwoFactorForm{}
+	app.render(w, http.StatusOK, "login_2fa.html", data)
+}
+
+// userLogInTwoFactorPost is the second step of the login, the user is logged
+// in once the code from their app or a recovery code is right.
+func (app *application) userLogInTwoFactorPost(w http.ResponseWriter, r *http.Request) {
+	userId, ok := app.pendingTwoFactor(r)
+	if !ok {
+		app.sessionManager.Put(r.Context(), "flash", "That took too long, log in again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	var form TwoFactorForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Code), "code", "Code can't be empty.")
+	status := http.StatusUnprocessableEntity
+	if form.Valid() {
+		if allowed, wait := app.twoFactorLimiter.allow(userId); !allowed {
+			rateLimitHits.Add("two_factor", 1)
+			form.AddNonFieldError(fmt.Sprintf("Too many tries, wait %d seconds.", int(math.Ceil(wait.Seconds()))))
+			status = http.StatusTooManyRequests
+		} else {
+			ok, err := app.twoFactor.Check(userId, form.Code)
+			if err != nil && !errors.Is(err, models.ErrNoRecord) {
+				app.serverErrror(w, err)
+				return
+			}
+			form.CheckField(ok, "code", "That code isn't right.")
+		}
+	}
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, status, "login_2fa.html", data)
+		return
+	}
+
+	err = app.logIn(r, userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// twoFactorSecret returns the secret being enrolled, a new one is kept in the
+// session until it is confirmed.
+func (app *application) twoFactorSecret(r *http.Request) ([]byte, error) {
+	if s := app.sessionManager.GetString(r.Context(), "totpSecret"); s != "" {
+		return totp.Encoding.DecodeString(s)
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	app.sessionManager.Put(r.Context(), "totpSecret", totp.Encoding.EncodeToString(secret))
+	return secret, nil
+}
+
+// twoFactorView shows how to enroll an authenticator app, or how to turn two
+// factor authentication off if it is on.
+func (app *application) twoFactorView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	data := app.newTemplateData(r)
+
+	var err error
+	data.TwoFactor, err = app.twoFactor.Enabled(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	if data.TwoFactor {
+		if codes, ok := app.sessionManager.Pop(r.Context(), "recoveryCodes").([]string); ok {
+			data.RecoveryCodes = codes
+		}
+		data.RecoveryLeft, err = app.twoFactor.RecoveryCodesLeft(userId)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		data.Form = PasswordForm{}
+	} else {
+		secret, err := app.twoFactorSecret(r)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		data.TOTPSecret = groupSecret(totp.Encoding.EncodeToString(secret))
+		data.Form = TwoFactorForm{}
+	}
+	app.render(w, http.StatusOK, "two_factor.html", data)
+}
+
+// groupSecret splits a secret in groups of four so it is easier to type.
+func groupSecret(secret string) string {
+	var groups []string
+	for len(secret) > 4 {
+		groups = append(groups, secret[:4])
+		secret = secret[4:]
+	}
+	return strings.Join(append(groups, secret), " ")
+}
+
+// twoFactorQR serves the QR code of the secret being enrolled. It is served
+// as an image instead of inlined, the content security policy doesn't allow
+// data urls.
+func (app *application) twoFactorQR(w http.ResponseWriter, r *http.Request) {
+	s := app.sessionManager.GetString(r.Context(), "totpSecret")
+	secret, err := totp.Encoding.DecodeString(s)
+	if s == "" || err != nil {
+		app.notFound(w)
+		return
+	}
+
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	code, err := qr.Encode(totp.URI(totpIssuer, user.Email, secret), qr.M, qr.Auto)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	code, err = barcode.Scale(code, 256, 256)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	err = png.Encode(w, code)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// twoFactorEnablePost turns two factor authentication on once a code shows
+// the app was set up right. The recovery codes are shown once after.
+func (app *application) twoFactorEnablePost(w http.ResponseWriter, r *http.Request) {
+	s := app.sessionManager.GetString(r.Context(), "totpSecret")
+	secret, err := totp.Encoding.DecodeString(s)
+	if s == "" || err != nil {
+		http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+		return
+	}
+
+	var form TwoFactorForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	step, ok := totp.Validate(secret, form.Code, time.Now())
+	form.CheckField(ok, "code", "That code isn't right, check the clock of your device.")
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.TOTPSecret = groupSecret(s)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "two_factor.html", data)
+		return
+	}
+
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	codes, err := app.twoFactor.Enable(userId, secret, step)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	app.sessionManager.Remove(r.Context(), "totpSecret")
+	app.sessionManager.Put(r.Context(), "recoveryCodes", codes)
+	http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+}
+
+// twoFactorDisablePost turns two factor authentication off after the
+// password is entered again.
+func (app *application) twoFactorDisablePost(w http.ResponseWriter, r *http.Request) {
+	var form PasswordForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	err = app.users.CheckPassword(userId, form.Password)
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidCredentials) {
+			app.serverErrror(w, err)
+			return
+		}
+		form.AddFieldError("password", "Password is incorrect.")
+		data := app.newTemplateData(r)
+		data.TwoFactor = true
+		data.RecoveryLeft, err = app.twoFactor.RecoveryCodesLeft(userId)
+		if err != nil {
+			app.serverErrror(w, err)
+			return
+		}
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "two_factor.html", data)
+		return
+	}
+
+	err = app.twoFactor.Disable(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Two-factor authentication is off.")
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tsundere-Musume/message/internal/mailer"
+	"github.com/Tsundere-Musume/message/internal/models"
+	"github.com/Tsundere-Musume/message/internal/validator"
+)
+
+// verifyLinkTTL is how long an email verification link works.
+const verifyLinkTTL = 48 * time.Hour
+
+// verifySignature signs the user id, email address and expiry of a
+// verification link, so a link stops working when the address changes.
+func (app *application) verifySignature(userId, email string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(app.config.secretKey))
+	fmt.Fprintf(mac, "verify-email\x00%s\x00%s\x00%d", userId, strings.ToLower(email), expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendVerification mails user a signed link that verifies their address.
+func (app *application) sendVerification(user *models.User) {
+	expires := time.Now().Add(verifyLinkTTL).Unix()
+	query := url.Values{
+		"user":    {user.ID.String()},
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {app.verifySignature(user.ID.String(), user.Email, expires)},
+	}
+	app.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link within two days to verify your email address:\n\n%s\n\n"+
+			"Until then you can only message your friends. If you didn't sign up, ignore this email.\n",
+			user.Name, app.link("/user/verify?"+query.Encode())),
+	})
+}
+
+// verifyEmail checks the link from the verification email. It doesn't need a
+// login, the link may be opened in another browser.
+func (app *application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userId := query.Get("user")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if !validator.IsUUID(userId) || err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.users.Get(userId)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverErrror(w, err)
+		return
+	}
+	if user == nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(app.verifySignature(userId, user.Email, expires)), []byte(query.Get("sig"))) {
+		app.sessionManager.Put(r.Context(), "flash", "That verification link is invalid or has expired.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = app.users.Verify(userId, user.Email)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "flash", "Your email address is verified.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// verifyResendPost mails the user a new verification link, at most as often
+// as the mail limit allows.
+func (app *application) verifyResendPost(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetString(r.Context(), "authenticatedUserID")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		app.serverErrror(w, err)
+		return
+	}
+
+	switch {
+	case user.Verified:
+		app.sessionManager.Put(r.Context(), "flash", "Your email address is already verified.")
+	default:
+		if ok, wait := app.mailLimiter.allow(strings.ToLower(user.Email)); !ok {
+			rateLimitHits.Add("mail", 1)
+			minutes := int(wait.Round(time.Minute).Minutes())
+			app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("We sent you a link recently, try again in %d minutes.", max(minutes, 1)))
+			break
+		}
+		app.sendVerification(user)
+		app.sessionManager.Put(r.Context(), "flash", "We sent you a new verification link.")
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
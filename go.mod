@@ -14,3 +14,13 @@ require (
 	golang.org/x/crypto v0.25.0
 	nhooyr.io/websocket v1.8.11
 )
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require (
+	github.com/boombuler/barcode v1.1.0
+	github.com/coreos/go-oidc/v3 v3.11.0
+	golang.org/x/oauth2 v0.21.0
+)
+
+require github.com/go-jose/go-jose/v4 v4.0.2
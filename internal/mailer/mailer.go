@@ -0,0 +1,133 @@
+// Package mailer sends the emails of the app, like password reset links,
+// through SMTP or, for local development, into files and the log.
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email to a single recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// headerEscaper keeps header values on a single line.
+var headerEscaper = strings.NewReplacer("\r", "", "\n", "")
+
+// format renders msg as an RFC 5322 message sent by from.
+func (msg Message) format(from string) ([]byte, error) {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if _, d, ok := strings.Cut(addr.Address, "@"); ok {
+			domain = d
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", headerEscaper.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerEscaper.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerEscaper.Replace(msg.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id[:]), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	_, err = w.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n")))
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// SMTP sends messages through an SMTP server. The connection is upgraded with
+// STARTTLS when the server supports it and credentials are only sent over TLS
+// or to localhost.
+type SMTP struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTP(host string, port int, username, password, from string) *SMTP {
+	s := &SMTP{
+		addr: net.JoinHostPort(host, strconv.Itoa(port)),
+		from: from,
+	}
+	if username != "" {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+func (s *SMTP) Send(msg Message) error {
+	from, err := mail.ParseAddress(s.from)
+	if err != nil {
+		return err
+	}
+	b, err := msg.format(s.from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, from.Address, []string{msg.To}, b)
+}
+
+// File writes every message to an .eml file in Dir and logs where it went,
+// for local development and tests. If Dir is empty the message is only
+// written to the log.
+type File struct {
+	Dir  string
+	From string
+	Log  *log.Logger
+}
+
+func (f *File) Send(msg Message) error {
+	if f.Dir == "" {
+		// unencoded so links can be copied from the log
+		f.Log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	b, err := msg.format(f.From)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(f.Dir, fmt.Sprintf("%d.eml", time.Now().UnixNano()))
+	err = os.WriteFile(name, b, 0o600)
+	if err != nil {
+		return err
+	}
+	f.Log.Printf("Mail to %s written to %s", msg.To, name)
+	return nil
+}
@@ -0,0 +1,105 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string
+		versions []int64
+		noDown   []int64
+		wantErr  bool
+	}{
+		{
+			name: "sorted by version",
+			files: []string{
+				"10_ten.up.sql", "10_ten.down.sql",
+				"2_two.up.sql", "2_two.down.sql",
+				"0001_one.down.sql", "0001_one.up.sql",
+			},
+			versions: []int64{1, 2, 10},
+		},
+		{
+			name:     "down is optional",
+			files:    []string{"0001_one.up.sql", "0002_two.up.sql", "0002_two.down.sql"},
+			versions: []int64{1, 2},
+			noDown:   []int64{1},
+		},
+		{
+			name:    "down without up",
+			files:   []string{"0001_one.up.sql", "0002_two.down.sql"},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate version",
+			files:   []string{"0001_one.up.sql", "0001_other.up.sql"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid file name",
+			files:   []string{"0001_one.up.sql", "one.sql"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, name := range tt.files {
+				fsys["migrations/"+name] = &fstest.MapFile{Data: []byte(name)}
+			}
+
+			migrations, err := load(fsys, "migrations")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got migrations %v, want an error", migrations)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(migrations) != len(tt.versions) {
+				t.Fatalf("got %d migrations, want %d", len(migrations), len(tt.versions))
+			}
+			for i, m := range migrations {
+				if m.Version != tt.versions[i] {
+					t.Errorf("migration %d: got version %d, want %d", i, m.Version, tt.versions[i])
+				}
+				// every file holds its own name
+				if !strings.HasSuffix(m.Up, "_"+m.Name+".up.sql") {
+					t.Errorf("migration %d: got up script %q", i, m.Up)
+				}
+				wantDown := true
+				for _, v := range tt.noDown {
+					if v == m.Version {
+						wantDown = false
+					}
+				}
+				if wantDown != strings.HasSuffix(m.Down, "_"+m.Name+".down.sql") {
+					t.Errorf("migration %d: got down script %q", i, m.Down)
+				}
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := load(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("%d_%s: versions must follow each other, want %d", m.Version, m.Name, i+1)
+		}
+		if m.Down == "" {
+			t.Errorf("%d_%s: has no down script", m.Version, m.Name)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS direct_message;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS friends;
+DROP TABLE IF EXISTS users;
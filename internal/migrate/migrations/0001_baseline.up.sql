@@ -0,0 +1,35 @@
+-- the schema the Init functions created before migrations existed. Those
+-- databases already have these tables, so only what is missing is created and
+-- every later change is a migration of its own.
+CREATE TABLE IF NOT EXISTS users (
+	id UUID PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	email VARCHAR(255) NOT NULL UNIQUE,
+	hashed_password CHAR(60) NOT NULL,
+	created TIMESTAMP NOT NULL,
+	avatar VARCHAR(255) DEFAULT 'default_img.jpeg'
+);
+
+CREATE TABLE IF NOT EXISTS friends (
+	user_id_1 UUID,
+	user_id_2 UUID,
+	PRIMARY KEY (user_id_1, user_id_2),
+	FOREIGN KEY (user_id_1) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id_2) REFERENCES users(id) ON DELETE CASCADE,
+	CHECK (user_id_1 < user_id_2)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	token TEXT PRIMARY KEY,
+	data BYTEA NOT NULL,
+	expiry TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions (expiry);
+
+CREATE TABLE IF NOT EXISTS direct_message (
+	from_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	to_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	body TEXT NOT NULL,
+	created TIMESTAMP NOT NULL
+);
@@ -0,0 +1,24 @@
+-- the migrations up to 0007 may find their changes already made by the Init
+-- functions of a newer build, so they use IF NOT EXISTS as well.
+CREATE TABLE IF NOT EXISTS groups (
+	id UUID PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	owner_id UUID REFERENCES users(id) ON DELETE SET NULL,
+	created TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+	group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+	user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	joined TIMESTAMP NOT NULL,
+	PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS group_members_user_idx ON group_members (user_id);
+
+CREATE TABLE IF NOT EXISTS group_message (
+	from_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+	body TEXT NOT NULL,
+	created TIMESTAMP NOT NULL
+);
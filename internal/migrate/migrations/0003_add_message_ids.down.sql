@@ -0,0 +1,5 @@
+ALTER TABLE group_message DROP COLUMN IF EXISTS id;
+
+ALTER TABLE direct_message DROP COLUMN IF EXISTS deleted;
+ALTER TABLE direct_message DROP COLUMN IF EXISTS edited;
+ALTER TABLE direct_message DROP COLUMN IF EXISTS id;
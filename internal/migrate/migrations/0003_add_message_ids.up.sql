@@ -0,0 +1,5 @@
+ALTER TABLE direct_message ADD COLUMN IF NOT EXISTS id UUID PRIMARY KEY DEFAULT gen_random_uuid();
+ALTER TABLE direct_message ADD COLUMN IF NOT EXISTS edited TIMESTAMP;
+ALTER TABLE direct_message ADD COLUMN IF NOT EXISTS deleted TIMESTAMP;
+
+ALTER TABLE group_message ADD COLUMN IF NOT EXISTS id UUID PRIMARY KEY DEFAULT gen_random_uuid();
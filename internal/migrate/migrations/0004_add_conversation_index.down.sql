@@ -0,0 +1 @@
+DROP INDEX IF EXISTS direct_message_conversation_idx;
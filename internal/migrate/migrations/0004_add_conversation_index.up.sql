@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS direct_message_conversation_idx ON direct_message (from_id, to_id, created, id);
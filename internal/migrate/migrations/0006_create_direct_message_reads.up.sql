@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS direct_message_reads (
+	user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	peer_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	last_read_id UUID NOT NULL,
+	last_read TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, peer_id)
+);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS group_message_body_tsv_idx;
+ALTER TABLE group_message DROP COLUMN IF EXISTS body_tsv;
+
+DROP INDEX IF EXISTS direct_message_body_tsv_idx;
+ALTER TABLE direct_message DROP COLUMN IF EXISTS body_tsv;
@@ -0,0 +1,7 @@
+ALTER TABLE direct_message ADD COLUMN IF NOT EXISTS body_tsv tsvector
+	GENERATED ALWAYS AS (to_tsvector('english', body)) STORED;
+CREATE INDEX IF NOT EXISTS direct_message_body_tsv_idx ON direct_message USING GIN (body_tsv);
+
+ALTER TABLE group_message ADD COLUMN IF NOT EXISTS body_tsv tsvector
+	GENERATED ALWAYS AS (to_tsvector('english', body)) STORED;
+CREATE INDEX IF NOT EXISTS group_message_body_tsv_idx ON group_message USING GIN (body_tsv);
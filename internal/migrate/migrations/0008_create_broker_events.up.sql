@@ -0,0 +1,7 @@
+-- events too large for a NOTIFY payload, read back by every instance and
+-- cleaned up once they are old enough that everyone had a chance to
+CREATE UNLOGGED TABLE IF NOT EXISTS broker_events (
+	id BIGSERIAL PRIMARY KEY,
+	payload TEXT NOT NULL,
+	created TIMESTAMP NOT NULL
+);
@@ -0,0 +1,11 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS accept_messages VARCHAR(16) NOT NULL DEFAULT 'friends'
+	CHECK (accept_messages IN ('friends', 'anyone'));
+
+CREATE TABLE IF NOT EXISTS user_blocks (
+	user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	blocked_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	created TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, blocked_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_blocks_blocked_idx ON user_blocks (blocked_id);
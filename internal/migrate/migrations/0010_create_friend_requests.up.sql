@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS friend_requests (
+	id UUID PRIMARY KEY,
+	from_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	to_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	status VARCHAR(16) NOT NULL DEFAULT 'pending'
+		CHECK (status IN ('pending', 'accepted', 'declined')),
+	created TIMESTAMP NOT NULL,
+	responded TIMESTAMP
+);
+
+-- only one open request from a user to another
+CREATE UNIQUE INDEX IF NOT EXISTS friend_requests_pending_idx ON friend_requests (from_id, to_id)
+	WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS friend_requests_to_idx ON friend_requests (to_id, status);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS user_mutes (
+	user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	muted_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	created TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, muted_id)
+);
@@ -0,0 +1,6 @@
+-- pg_trgm is shipped with postgres but creating it needs a role allowed to
+-- create extensions
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- serves both the prefix and the similarity matches of the user directory
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING GIN (lower(name) gin_trgm_ops);
@@ -0,0 +1,9 @@
+-- only the sha256 of a token is stored, the token itself is in the email
+CREATE TABLE IF NOT EXISTS password_resets (
+	token_hash BYTEA PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created TIMESTAMP NOT NULL,
+	expiry TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS password_resets_user_idx ON password_resets (user_id);
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified TIMESTAMP;
+
+-- accounts from before verification existed are trusted
+UPDATE users SET email_verified = created WHERE email_verified IS NULL;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS user_totp (
+	user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	secret BYTEA NOT NULL,
+	-- the last time step a code was accepted for, codes can't be used twice
+	last_step BIGINT NOT NULL DEFAULT 0,
+	enabled TIMESTAMP NOT NULL
+);
+
+-- only the sha256 of a recovery code is stored
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	code_hash BYTEA,
+	PRIMARY KEY (user_id, code_hash)
+);
@@ -0,0 +1,12 @@
+-- accounts at an OpenID Connect provider, a subject is only unique within
+-- its issuer
+CREATE TABLE IF NOT EXISTS user_identities (
+	issuer TEXT,
+	subject TEXT,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	email VARCHAR(255) NOT NULL DEFAULT '',
+	created TIMESTAMP NOT NULL,
+	PRIMARY KEY (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_idx ON user_identities (user_id);
@@ -0,0 +1,12 @@
+-- one row per logged in browser, the session cookie only holds the id so a
+-- session can be listed and revoked from any other one
+CREATE TABLE IF NOT EXISTS user_sessions (
+	id UUID PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	created TIMESTAMP NOT NULL,
+	last_seen TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS user_sessions_user_idx ON user_sessions (user_id);
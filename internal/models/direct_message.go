@@ -3,36 +3,95 @@ package models
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 type DirectMessage struct {
-	//TODO: maybe add message id or not
-	// messageId uuid.UUID
-	FromId   string    `json:"from_id"`
-	ToId     string    `json:"to_id"`
-	Body     string    `json:"body"`
-	Created  time.Time `json:"created"`
-	Sender   string    `json:"sender"`   // field not stored in db
-	Receiver string    `json:"receiver"` // field not stored in db
+	ID       string     `json:"id"`
+	FromId   string     `json:"from_id"`
+	ToId     string     `json:"to_id"`
+	Body     string     `json:"body"`
+	Created  time.Time  `json:"created"`
+	Edited   *time.Time `json:"edited,omitempty"`
+	Deleted  bool       `json:"deleted"`
+	Sender   string     `json:"sender"`   // field not stored in db
+	Receiver string     `json:"receiver"` // field not stored in db
+}
+
+// Conversation is a direct conversation with another user as shown in the
+// conversation list. LastMessage is nil if nothing was sent yet.
+type Conversation struct {
+	User        *User
+	LastMessage *DirectMessage
+	Muted       bool
+	IsFriend    bool
 }
 
 type DirectMessageModel struct {
 	DB *sql.DB
 }
 
-func (m *DirectMessageModel) GetMessagesForUser(currentUserId, userId string) ([]*DirectMessage, error) {
-	// stmt := "SELECT body, created FROM direct_message WHERE (from_id = $1 AND to_id = $2) OR (from_id = $2 AND to_id = $1);"
-	stmt := `
-      select dm.from_id, dm.to_id, dm.body, dm.created, u1.name as sender, u2.name as receiver
+// Page selects a window of a conversation. Before, After and From are message
+// ids used as keyset cursors, From includes the message itself. When none is
+// set the latest messages are returned.
+type Page struct {
+	Before string
+	After  string
+	From   string
+	Limit  int
+}
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// GetMessagesForUser returns a page of the conversation between the two users
+// in chronological order.
+func (m *DirectMessageModel) GetMessagesForUser(currentUserId, userId string, page Page) ([]*DirectMessage, error) {
+	if page.Limit <= 0 || page.Limit > MaxPageSize {
+		page.Limit = DefaultPageSize
+	}
+
+	// newest first when paging backwards so the limit keeps the messages
+	// closest to the cursor, the rows are reversed afterwards
+	var cursor, order string
+	args := []any{currentUserId, userId, page.Limit}
+	switch {
+	case page.Before != "":
+		cursor = "and (dm.created, dm.id) < (select created, id from direct_message where id = $4)"
+		order = "desc"
+		args = append(args, page.Before)
+	case page.After != "":
+		cursor = "and (dm.created, dm.id) > (select created, id from direct_message where id = $4)"
+		order = "asc"
+		args = append(args, page.After)
+	case page.From != "":
+		cursor = "and (dm.created, dm.id) >= (select created, id from direct_message where id = $4)"
+		order = "asc"
+		args = append(args, page.From)
+	default:
+		order = "desc"
+	}
+
+	stmt := fmt.Sprintf(`
+      select dm.id, dm.from_id, dm.to_id, dm.body, dm.created, dm.edited, dm.deleted is not null,
+      u1.name as sender, u2.name as receiver
       from direct_message dm
       join users u1 on dm.from_id = u1.id
       join users u2 on dm.to_id = u2.id
-      where (dm.from_id = $1 AND dm.to_id = $2)
-      or (dm.from_id = $2 and dm.to_id= $1)
-      order by dm.created;
-  `
-	rows, err := m.DB.Query(stmt, currentUserId, userId)
+      where ((dm.from_id = $1 AND dm.to_id = $2)
+      or (dm.from_id = $2 and dm.to_id= $1))
+      %s
+      order by dm.created %s, dm.id %s
+      limit $3;
+  `, cursor, order, order)
+	rows, err := m.DB.Query(stmt, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +101,7 @@ func (m *DirectMessageModel) GetMessagesForUser(currentUserId, userId string) ([
 
 	for rows.Next() {
 		msg := &DirectMessage{}
-		err := rows.Scan(&msg.FromId, &msg.ToId, &msg.Body, &msg.Created, &msg.Sender, &msg.Receiver)
+		err := rows.Scan(&msg.ID, &msg.FromId, &msg.ToId, &msg.Body, &msg.Created, &msg.Edited, &msg.Deleted, &msg.Sender, &msg.Receiver)
 		if err != nil {
 			return nil, err
 		}
@@ -51,15 +110,235 @@ func (m *DirectMessageModel) GetMessagesForUser(currentUserId, userId string) ([
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
+
+	if order == "desc" {
+		slices.Reverse(messages)
+	}
 	return messages, nil
 }
-func (m *DirectMessageModel) Send(senderId, receiverId, msg string) error {
-	stmt := "INSERT INTO direct_message (from_id, to_id, body, created) VALUES ($1,$2,$3,$4);"
-	_, err := m.DB.Exec(stmt, senderId, receiverId, msg, time.Now().UTC())
+
+// Send stores a new message and returns it with its id and creation time set.
+func (m *DirectMessageModel) Send(senderId, receiverId, msg string) (*DirectMessage, error) {
+	dm := &DirectMessage{
+		ID:      uuid.NewString(),
+		FromId:  senderId,
+		ToId:    receiverId,
+		Body:    msg,
+		Created: time.Now().UTC(),
+	}
+	stmt := "INSERT INTO direct_message (id, from_id, to_id, body, created) VALUES ($1,$2,$3,$4,$5);"
+	_, err := m.DB.Exec(stmt, dm.ID, dm.FromId, dm.ToId, dm.Body, dm.Created)
+	if err != nil {
+		return nil, err
+	}
+	return dm, nil
+}
+
+// Edit replaces the body of a message. Only the sender can edit a message and
+// deleted messages can't be edited.
+func (m *DirectMessageModel) Edit(id, senderId, body string) (*DirectMessage, error) {
+	stmt := `
+      with dm as (
+        update direct_message set body = $3, edited = $4
+        where id = $1 and from_id = $2 and deleted is null
+        returning id, from_id, to_id, body, created, edited
+      )
+      select dm.id, dm.from_id, dm.to_id, dm.body, dm.created, dm.edited,
+      u1.name as sender, u2.name as receiver
+      from dm
+      join users u1 on dm.from_id = u1.id
+      join users u2 on dm.to_id = u2.id;
+  `
+	msg := &DirectMessage{}
+	err := m.DB.QueryRow(stmt, id, senderId, body, time.Now().UTC()).Scan(&msg.ID, &msg.FromId, &msg.ToId, &msg.Body, &msg.Created, &msg.Edited, &msg.Sender, &msg.Receiver)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Delete soft deletes a message. The row is kept as a tombstone so the
+// conversation still shows that something was there, but the body is wiped.
+func (m *DirectMessageModel) Delete(id, senderId string) (*DirectMessage, error) {
+	stmt := `
+      with dm as (
+        update direct_message set body = '', deleted = $3
+        where id = $1 and from_id = $2 and deleted is null
+        returning id, from_id, to_id, body, created, edited
+      )
+      select dm.id, dm.from_id, dm.to_id, dm.body, dm.created, dm.edited,
+      u1.name as sender, u2.name as receiver
+      from dm
+      join users u1 on dm.from_id = u1.id
+      join users u2 on dm.to_id = u2.id;
+  `
+	msg := &DirectMessage{Deleted: true}
+	err := m.DB.QueryRow(stmt, id, senderId, time.Now().UTC()).Scan(&msg.ID, &msg.FromId, &msg.ToId, &msg.Body, &msg.Created, &msg.Edited, &msg.Sender, &msg.Receiver)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// MarkRead moves the read cursor of userId in the conversation with peerId
+// forward to messageId, a message peerId sent. It reports false if the
+// message doesn't exist or the cursor was already past it.
+func (m *DirectMessageModel) MarkRead(userId, peerId, messageId string) (bool, error) {
+	stmt := `
+      insert into direct_message_reads (user_id, peer_id, last_read_id, last_read)
+      select $1, $2, dm.id, dm.created
+      from direct_message dm
+      where dm.id = $3 and dm.from_id = $2 and dm.to_id = $1
+      on conflict (user_id, peer_id) do update
+      set last_read_id = excluded.last_read_id, last_read = excluded.last_read
+      where direct_message_reads.last_read < excluded.last_read;
+  `
+	res, err := m.DB.Exec(stmt, userId, peerId, messageId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// LastRead returns the id of the last message from peerId that userId has
+// read, or an empty string if they haven't read anything yet.
+func (m *DirectMessageModel) LastRead(userId, peerId string) (string, error) {
+	var id string
+	stmt := "SELECT last_read_id FROM direct_message_reads WHERE user_id = $1 AND peer_id = $2"
+	err := m.DB.QueryRow(stmt, userId, peerId).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return id, nil
+}
+
+// UnreadCounts returns the number of unread messages sent to userId keyed by
+// the id of the sender. Muted senders are left out.
+func (m *DirectMessageModel) UnreadCounts(userId string) (map[string]int, error) {
+	stmt := `
+      select dm.from_id, count(*)
+      from direct_message dm
+      left join direct_message_reads r on r.user_id = dm.to_id and r.peer_id = dm.from_id
+      where dm.to_id = $1 and dm.deleted is null
+      and (r.last_read is null or dm.created > r.last_read)
+      and not exists(select true from user_mutes m where m.user_id = $1 and m.muted_id = dm.from_id)
+      group by dm.from_id;
+  `
+	rows, err := m.DB.Query(stmt, userId)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	defer rows.Close()
+	counts := make(map[string]int)
+
+	for rows.Next() {
+		var fromId string
+		var count int
+		err := rows.Scan(&fromId, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[fromId] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Conversations returns a conversation for every user userId exchanged
+// messages with, and for every friend even without messages, with the latest
+// message in it. The most recently active conversations come first. Users
+// blocked either way are left out, and only friends get their last seen time.
+func (m *DirectMessageModel) Conversations(userId string) ([]*Conversation, error) {
+	stmt := `
+      with peers as (
+        select case when dm.from_id = $1 then dm.to_id else dm.from_id end as id
+        from direct_message dm
+        where dm.from_id = $1 or dm.to_id = $1
+        union
+        select case when f.user_id_1 = $1 then f.user_id_2 else f.user_id_1 end
+        from friends f
+        where f.user_id_1 = $1 or f.user_id_2 = $1
+      )
+      select u.id, u.name, u.avatar, u.last_seen,
+      lm.id, lm.from_id, lm.to_id, lm.body, lm.created, lm.deleted is not null, s.name,
+      exists(select true from user_mutes m where m.user_id = $1 and m.muted_id = u.id),
+      exists(select true from friends f
+        where (f.user_id_1 = $1 and f.user_id_2 = u.id)
+        or (f.user_id_1 = u.id and f.user_id_2 = $1))
+      from peers p
+      join users u on u.id = p.id
+      left join lateral (
+        select dm.id, dm.from_id, dm.to_id, dm.body, dm.created, dm.deleted
+        from direct_message dm
+        where (dm.from_id = $1 and dm.to_id = u.id)
+        or (dm.from_id = u.id and dm.to_id = $1)
+        order by dm.created desc, dm.id desc
+        limit 1
+      ) lm on true
+      left join users s on s.id = lm.from_id
+      where u.id <> $1
+      and not exists(select true from user_blocks b
+        where (b.user_id = $1 and b.blocked_id = u.id)
+        or (b.user_id = u.id and b.blocked_id = $1))
+      order by lm.created desc nulls last, u.name;
+  `
+	rows, err := m.DB.Query(stmt, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	conversations := []*Conversation{}
+
+	for rows.Next() {
+		user := &User{}
+		var lastSeen, created sql.NullTime
+		var id, fromId, toId, body, sender sql.NullString
+		var deleted sql.NullBool
+		var muted, isFriend bool
+		err := rows.Scan(&user.ID, &user.Name, &user.AvatarUrl, &lastSeen, &id, &fromId, &toId, &body, &created, &deleted, &sender, &muted, &isFriend)
+		if err != nil {
+			return nil, err
+		}
+		// when someone was last seen is only shared with their friends
+		if isFriend {
+			user.LastSeen = lastSeen.Time
+		}
+
+		conversation := &Conversation{User: user, Muted: muted, IsFriend: isFriend}
+		if id.Valid {
+			conversation.LastMessage = &DirectMessage{
+				ID:      id.String,
+				FromId:  fromId.String,
+				ToId:    toId.String,
+				Body:    body.String,
+				Created: created.Time,
+				Deleted: deleted.Bool,
+				Sender:  sender.String,
+			}
+		}
+		conversations = append(conversations, conversation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
-	return nil
+	return conversations, nil
 }
 
 func (m *DirectMessage) Serialize() ([]byte, error) {
@@ -8,4 +8,9 @@ var (
 	ErrDuplicateEmail     = errors.New("models: duplicate email")
 	ErrNotFound           = errors.New("404 page not found")
 	ErrNoAvatarImg        = errors.New("Avatar image missing in post data.")
+	ErrAlreadyFriends     = errors.New("models: already friends")
+	ErrDuplicateRequest   = errors.New("models: friend request already sent")
+	ErrBlocked            = errors.New("models: user is blocked")
+	ErrInvalidToken       = errors.New("models: invalid or expired token")
+	ErrIdentityTaken      = errors.New("models: identity linked to another user")
 )
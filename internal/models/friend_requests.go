@@ -0,0 +1,231 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	RequestPending  = "pending"
+	RequestAccepted = "accepted"
+	RequestDeclined = "declined"
+)
+
+type FriendRequest struct {
+	ID        uuid.UUID
+	FromId    string
+	ToId      string
+	Status    string
+	Created   time.Time
+	Responded *time.Time
+	User      *User // the other user, only set in the request lists
+}
+
+type FriendRequestModel struct {
+	DB *sql.DB
+}
+
+// friendPair orders two user ids the way the friends table stores them.
+func friendPair(userId, otherId string) (string, string) {
+	if userId < otherId {
+		return userId, otherId
+	}
+	return otherId, userId
+}
+
+func addFriend(tx *sql.Tx, userId, otherId string) error {
+	id1, id2 := friendPair(userId, otherId)
+	stmt := `
+    INSERT INTO friends (user_id_1, user_id_2)
+    VALUES ($1, $2)
+    ON CONFLICT (user_id_1, user_id_2) DO NOTHING;
+  `
+	_, err := tx.Exec(stmt, id1, id2)
+	return err
+}
+
+// Send asks toId to become friends with fromId. If toId already asked fromId
+// that request is accepted instead and returned. Users that blocked each other
+// can't send requests.
+func (m *FriendRequestModel) Send(fromId, toId string) (*FriendRequest, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var friends, blocked bool
+	id1, id2 := friendPair(fromId, toId)
+	stmt := `
+    SELECT EXISTS(SELECT true FROM friends WHERE user_id_1 = $1 AND user_id_2 = $2),
+    EXISTS(SELECT true FROM user_blocks
+      WHERE (user_id = $1 AND blocked_id = $2) OR (user_id = $2 AND blocked_id = $1));
+  `
+	err = tx.QueryRow(stmt, id1, id2).Scan(&friends, &blocked)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, ErrBlocked
+	}
+	if friends {
+		return nil, ErrAlreadyFriends
+	}
+
+	now := time.Now().UTC()
+	req := &FriendRequest{FromId: toId, ToId: fromId, Status: RequestAccepted, Responded: &now}
+	stmt = `
+    UPDATE friend_requests SET status = 'accepted', responded = $3
+    WHERE from_id = $1 AND to_id = $2 AND status = 'pending'
+    RETURNING id, created;
+  `
+	err = tx.QueryRow(stmt, toId, fromId, now).Scan(&req.ID, &req.Created)
+	switch {
+	case err == nil:
+		err = addFriend(tx, fromId, toId)
+		if err != nil {
+			return nil, err
+		}
+		return req, tx.Commit()
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	req = &FriendRequest{ID: uuid.New(), FromId: fromId, ToId: toId, Status: RequestPending, Created: now}
+	stmt = "INSERT INTO friend_requests (id, from_id, to_id, status, created) VALUES ($1, $2, $3, $4, $5);"
+	_, err = tx.Exec(stmt, req.ID, req.FromId, req.ToId, req.Status, req.Created)
+	if err != nil {
+		if strings.Contains(err.Error(), "friend_requests_pending_idx") {
+			return nil, ErrDuplicateRequest
+		}
+		return nil, err
+	}
+	return req, tx.Commit()
+}
+
+// Accept accepts a pending request sent to userId and makes both users
+// friends.
+func (m *FriendRequestModel) Accept(id, userId string) (*FriendRequest, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	req, err := respond(tx, id, userId, RequestAccepted)
+	if err != nil {
+		return nil, err
+	}
+	err = addFriend(tx, req.FromId, req.ToId)
+	if err != nil {
+		return nil, err
+	}
+	return req, tx.Commit()
+}
+
+// Decline declines a pending request sent to userId. The sender isn't told.
+func (m *FriendRequestModel) Decline(id, userId string) (*FriendRequest, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	req, err := respond(tx, id, userId, RequestDeclined)
+	if err != nil {
+		return nil, err
+	}
+	return req, tx.Commit()
+}
+
+func respond(tx *sql.Tx, id, userId, status string) (*FriendRequest, error) {
+	now := time.Now().UTC()
+	req := &FriendRequest{Status: status, Responded: &now}
+	stmt := `
+    UPDATE friend_requests SET status = $3, responded = $4
+    WHERE id = $1 AND to_id = $2 AND status = 'pending'
+    RETURNING id, from_id, to_id, created;
+  `
+	err := tx.QueryRow(stmt, id, userId, status, now).Scan(&req.ID, &req.FromId, &req.ToId, &req.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return req, nil
+}
+
+// Cancel withdraws a pending request userId sent.
+func (m *FriendRequestModel) Cancel(id, userId string) error {
+	stmt := "DELETE FROM friend_requests WHERE id = $1 AND from_id = $2 AND status = 'pending'"
+	res, err := m.DB.Exec(stmt, id, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// Incoming returns the pending requests sent to userId, newest first.
+func (m *FriendRequestModel) Incoming(userId string) ([]*FriendRequest, error) {
+	return m.pending(`
+    SELECT r.id, r.from_id, r.to_id, r.status, r.created, u.id, u.name, u.avatar
+    FROM friend_requests r
+    JOIN users u ON u.id = r.from_id
+    WHERE r.to_id = $1 AND r.status = 'pending'
+    ORDER BY r.created DESC;
+  `, userId)
+}
+
+// Outgoing returns the pending requests userId sent, newest first.
+func (m *FriendRequestModel) Outgoing(userId string) ([]*FriendRequest, error) {
+	return m.pending(`
+    SELECT r.id, r.from_id, r.to_id, r.status, r.created, u.id, u.name, u.avatar
+    FROM friend_requests r
+    JOIN users u ON u.id = r.to_id
+    WHERE r.from_id = $1 AND r.status = 'pending'
+    ORDER BY r.created DESC;
+  `, userId)
+}
+
+func (m *FriendRequestModel) pending(stmt, userId string) ([]*FriendRequest, error) {
+	rows, err := m.DB.Query(stmt, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	requests := []*FriendRequest{}
+
+	for rows.Next() {
+		req := &FriendRequest{User: &User{}}
+		err := rows.Scan(&req.ID, &req.FromId, &req.ToId, &req.Status, &req.Created, &req.User.ID, &req.User.Name, &req.User.AvatarUrl)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// IncomingCount returns the number of pending requests sent to userId.
+func (m *FriendRequestModel) IncomingCount(userId string) (int, error) {
+	var count int
+	stmt := "SELECT count(*) FROM friend_requests WHERE to_id = $1 AND status = 'pending'"
+	err := m.DB.QueryRow(stmt, userId).Scan(&count)
+	return count, err
+}
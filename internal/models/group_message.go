@@ -1,11 +1,18 @@
 package models
 
-import "time"
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 // should be the same for the most part, maybe changing to an interface instead of a concrete type  ?
 type GroupMessage struct {
-	//TODO: maybe add message id or not
-	// messageId uuid.UUID
+	ID       string    `json:"id"`
 	FromId   string    `json:"from_id"` // userID
 	ToId     string    `json:"to_id"`   // groupID
 	Body     string    `json:"body"`
@@ -13,3 +20,96 @@ type GroupMessage struct {
 	Sender   string    `json:"sender"`   // not store in db
 	Receiver string    `json:"receiver"` //not stored in db ; probably not used either
 }
+
+type GroupMessageModel struct {
+	DB *sql.DB
+}
+
+// GetMessagesForGroup returns a page of the group conversation in
+// chronological order, see Page.
+func (m *GroupMessageModel) GetMessagesForGroup(groupId string, page Page) ([]*GroupMessage, error) {
+	if page.Limit <= 0 || page.Limit > MaxPageSize {
+		page.Limit = DefaultPageSize
+	}
+
+	// newest first when paging backwards so the limit keeps the messages
+	// closest to the cursor, the rows are reversed afterwards
+	var cursor, order string
+	args := []any{groupId, page.Limit}
+	switch {
+	case page.Before != "":
+		cursor = "and (gm.created, gm.id) < (select created, id from group_message where id = $3)"
+		order = "desc"
+		args = append(args, page.Before)
+	case page.After != "":
+		cursor = "and (gm.created, gm.id) > (select created, id from group_message where id = $3)"
+		order = "asc"
+		args = append(args, page.After)
+	case page.From != "":
+		cursor = "and (gm.created, gm.id) >= (select created, id from group_message where id = $3)"
+		order = "asc"
+		args = append(args, page.From)
+	default:
+		order = "desc"
+	}
+
+	stmt := fmt.Sprintf(`
+      select gm.id, gm.from_id, gm.group_id, gm.body, gm.created, u.name as sender, g.name as receiver
+      from group_message gm
+      join users u on gm.from_id = u.id
+      join groups g on gm.group_id = g.id
+      where gm.group_id = $1
+      %s
+      order by gm.created %s, gm.id %s
+      limit $2;
+  `, cursor, order, order)
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	messages := []*GroupMessage{}
+
+	for rows.Next() {
+		msg := &GroupMessage{}
+		err := rows.Scan(&msg.ID, &msg.FromId, &msg.ToId, &msg.Body, &msg.Created, &msg.Sender, &msg.Receiver)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if order == "desc" {
+		slices.Reverse(messages)
+	}
+	return messages, nil
+}
+
+// Send stores a new message and returns it with its id and creation time set.
+func (m *GroupMessageModel) Send(senderId, groupId, msg string) (*GroupMessage, error) {
+	gm := &GroupMessage{
+		ID:      uuid.NewString(),
+		FromId:  senderId,
+		ToId:    groupId,
+		Body:    msg,
+		Created: time.Now().UTC(),
+	}
+	stmt := "INSERT INTO group_message (id, from_id, group_id, body, created) VALUES ($1,$2,$3,$4,$5);"
+	_, err := m.DB.Exec(stmt, gm.ID, gm.FromId, gm.ToId, gm.Body, gm.Created)
+	if err != nil {
+		return nil, err
+	}
+	return gm, nil
+}
+
+func (m *GroupMessage) Serialize() ([]byte, error) {
+	val, err := json.Marshal(m)
+	if err != nil {
+		return []byte{}, err
+	}
+	return val, nil
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Group struct {
+	ID      uuid.UUID
+	Name    string
+	OwnerID string
+	Created time.Time
+}
+
+type GroupModel struct {
+	DB *sql.DB
+}
+
+// Insert creates a new group and adds the owner as its first member.
+func (m *GroupModel) Insert(name, ownerId string) (uuid.UUID, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	defer tx.Rollback()
+
+	id := uuid.New()
+	now := time.Now().UTC()
+	stmt := "INSERT INTO groups (id, name, owner_id, created) VALUES ($1, $2, $3, $4);"
+	_, err = tx.Exec(stmt, id, name, ownerId, now)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	stmt = "INSERT INTO group_members (group_id, user_id, joined) VALUES ($1, $2, $3);"
+	_, err = tx.Exec(stmt, id, ownerId, now)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	return id, tx.Commit()
+}
+
+func (m *GroupModel) Get(id string) (*Group, error) {
+	group := &Group{}
+	var ownerId sql.NullString
+	stmt := "SELECT id, name, owner_id, created FROM groups WHERE id = $1"
+	err := m.DB.QueryRow(stmt, id).Scan(&group.ID, &group.Name, &ownerId, &group.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	group.OwnerID = ownerId.String
+	return group, nil
+}
+
+func (m *GroupModel) GetGroupsForUser(userId string) ([]*Group, error) {
+	stmt := `
+    SELECT g.id, g.name, g.owner_id, g.created
+    FROM groups g
+    JOIN group_members gm ON gm.group_id = g.id
+    WHERE gm.user_id = $1
+    ORDER BY g.name;
+  `
+	rows, err := m.DB.Query(stmt, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	groups := []*Group{}
+
+	for rows.Next() {
+		group := &Group{}
+		var ownerId sql.NullString
+		err := rows.Scan(&group.ID, &group.Name, &ownerId, &group.Created)
+		if err != nil {
+			return nil, err
+		}
+		group.OwnerID = ownerId.String
+		groups = append(groups, group)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (m *GroupModel) GetMembers(groupId string) ([]*User, error) {
+	stmt := `
+    SELECT u.id, u.name, u.avatar
+    FROM group_members gm
+    JOIN users u ON u.id = gm.user_id
+    WHERE gm.group_id = $1
+    ORDER BY gm.joined;
+  `
+	rows, err := m.DB.Query(stmt, groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	users := []*User{}
+
+	for rows.Next() {
+		user := &User{}
+		err := rows.Scan(&user.ID, &user.Name, &user.AvatarUrl)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (m *GroupModel) IsMember(groupId, userId string) (bool, error) {
+	var exists bool
+
+	stmt := "SELECT EXISTS(SELECT true FROM group_members WHERE group_id = $1 AND user_id = $2)"
+	err := m.DB.QueryRow(stmt, groupId, userId).Scan(&exists)
+	return exists, err
+}
+
+func (m *GroupModel) AddMember(groupId, userId string) error {
+	stmt := `
+    INSERT INTO group_members (group_id, user_id, joined)
+    VALUES ($1, $2, $3)
+    ON CONFLICT (group_id, user_id) DO NOTHING;
+  `
+	_, err := m.DB.Exec(stmt, groupId, userId, time.Now().UTC())
+	return err
+}
+
+func (m *GroupModel) RemoveMember(groupId, userId string) error {
+	stmt := "DELETE FROM group_members WHERE group_id = $1 AND user_id = $2;"
+	_, err := m.DB.Exec(stmt, groupId, userId)
+	return err
+}
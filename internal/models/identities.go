@@ -0,0 +1,168 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Identity is an account at an OpenID Connect provider that logs a user in.
+type Identity struct {
+	Issuer  string
+	Subject string
+	UserID  string
+	Email   string // what the provider said when it was linked
+	Created time.Time
+}
+
+// IdentityModelInterface is what the handlers use of IdentityModel, tests
+// replace it with one that doesn't need a database.
+type IdentityModelInterface interface {
+	UserID(issuer, subject string) (string, error)
+	Link(userId string, identity Identity) error
+	Unlink(userId, issuer, subject string) error
+	Identities(userId string) ([]*Identity, error)
+	CreateUser(name string, identity Identity, emailVerified bool) (uuid.UUID, error)
+}
+
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// UserID returns the user the identity is linked to.
+func (m *IdentityModel) UserID(issuer, subject string) (string, error) {
+	var userId string
+	stmt := "SELECT user_id FROM user_identities WHERE issuer = $1 AND subject = $2"
+	err := m.DB.QueryRow(stmt, issuer, subject).Scan(&userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNoRecord
+		}
+		return "", err
+	}
+	return userId, nil
+}
+
+// Link lets the identity log in as userId. Linking it again to the same user
+// does nothing, ErrIdentityTaken is returned if another user has it.
+func (m *IdentityModel) Link(userId string, identity Identity) error {
+	stmt := `
+    INSERT INTO user_identities (issuer, subject, user_id, email, created) VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT (issuer, subject) DO NOTHING;
+  `
+	res, err := m.DB.Exec(stmt, identity.Issuer, identity.Subject, userId, identity.Email, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 1 {
+		return err
+	}
+
+	owner, err := m.UserID(identity.Issuer, identity.Subject)
+	if err != nil {
+		return err
+	}
+	if owner != userId {
+		return ErrIdentityTaken
+	}
+	return nil
+}
+
+// Unlink removes an identity of userId, ErrNoRecord if they have no such
+// identity.
+func (m *IdentityModel) Unlink(userId, issuer, subject string) error {
+	stmt := "DELETE FROM user_identities WHERE user_id = $1 AND issuer = $2 AND subject = $3"
+	res, err := m.DB.Exec(stmt, userId, issuer, subject)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// Identities returns the identities linked to userId.
+func (m *IdentityModel) Identities(userId string) ([]*Identity, error) {
+	stmt := `
+    SELECT issuer, subject, user_id, email, created FROM user_identities
+    WHERE user_id = $1
+    ORDER BY created;
+  `
+	rows, err := m.DB.Query(stmt, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	identities := []*Identity{}
+
+	for rows.Next() {
+		identity := &Identity{}
+		err := rows.Scan(&identity.Issuer, &identity.Subject, &identity.UserID, &identity.Email, &identity.Created)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// CreateUser creates an account for the first login of an identity and links
+// them. The account gets an unusable random password, a password reset sets
+// a real one. The email address is verified if the provider verified it.
+func (m *IdentityModel) CreateUser(name string, identity Identity, emailVerified bool) (uuid.UUID, error) {
+	password := make([]byte, 32)
+	_, err := rand.Read(password)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword(password, 12)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	defer tx.Rollback()
+
+	id := uuid.New()
+	now := time.Now().UTC()
+	var verified *time.Time
+	if emailVerified {
+		verified = &now
+	}
+	stmt := `
+    INSERT INTO users (id, name, email, hashed_password, created, email_verified)
+    VALUES ($1, $2, $3, $4, $5, $6);
+  `
+	_, err = tx.Exec(stmt, id, name, identity.Email, hashedPassword, now, verified)
+	if err != nil {
+		if strings.Contains(err.Error(), "users_email_key") {
+			return uuid.UUID{}, ErrDuplicateEmail
+		}
+		return uuid.UUID{}, err
+	}
+
+	stmt = "INSERT INTO user_identities (issuer, subject, user_id, email, created) VALUES ($1, $2, $3, $4, $5)"
+	_, err = tx.Exec(stmt, identity.Issuer, identity.Subject, id, identity.Email, now)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	return id, tx.Commit()
+}
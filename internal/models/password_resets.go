@@ -0,0 +1,94 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type PasswordResetModel struct {
+	DB *sql.DB
+}
+
+// newToken returns a random url safe token and the hash of it that is stored.
+func newToken() (string, []byte, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// New creates a reset token for userId that is valid for ttl. Tokens created
+// before stay valid until they are used or expire.
+func (m *PasswordResetModel) New(userId string, ttl time.Duration) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	stmt := "INSERT INTO password_resets (token_hash, user_id, created, expiry) VALUES ($1, $2, $3, $4)"
+	_, err = m.DB.Exec(stmt, hash, userId, now, now.Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Valid reports whether token can still be used, so the form isn't shown for
+// a dead link.
+func (m *PasswordResetModel) Valid(token string) (bool, error) {
+	var valid bool
+	stmt := "SELECT EXISTS(SELECT true FROM password_resets WHERE token_hash = $1 AND expiry > $2)"
+	err := m.DB.QueryRow(stmt, hashToken(token), time.Now().UTC()).Scan(&valid)
+	return valid, err
+}
+
+// Reset sets the password of the user the token was created for and returns
+// their id. The token and every other token of the user are used up.
+// ErrInvalidToken is returned for unknown, used or expired tokens.
+func (m *PasswordResetModel) Reset(token, password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userId string
+	stmt := "DELETE FROM password_resets WHERE token_hash = $1 AND expiry > $2 RETURNING user_id"
+	err = tx.QueryRow(stmt, hashToken(token), time.Now().UTC()).Scan(&userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidToken
+		}
+		return "", err
+	}
+
+	_, err = tx.Exec("UPDATE users SET hashed_password = $2 WHERE id = $1", userId, hashedPassword)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("DELETE FROM password_resets WHERE user_id = $1 OR expiry <= $2", userId, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	return userId, tx.Commit()
+}
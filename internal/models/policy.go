@@ -0,0 +1,214 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// who a user accepts direct messages from
+const (
+	AcceptFriends = "friends"
+	AcceptAnyone  = "anyone"
+)
+
+// Privacy holds the settings a user controls about who can reach them.
+type Privacy struct {
+	AcceptMessages string
+}
+
+// PolicyModel decides who may message whom.
+type PolicyModel struct {
+	DB *sql.DB
+}
+
+// CanMessage reports whether senderId may send direct messages to receiverId.
+// Users that blocked each other never can, friends always can and everyone
+// else only if the receiver accepts messages from anyone and the sender
+// verified their email address. Users can't message themselves. ErrNoRecord
+// is returned if the receiver doesn't exist.
+func (m *PolicyModel) CanMessage(senderId, receiverId string) (bool, error) {
+	stmt := `
+      select u.accept_messages,
+      coalesce((select s.email_verified is not null from users s where s.id = $1), false),
+      exists(select true from user_blocks b
+        where (b.user_id = $1 and b.blocked_id = $2)
+        or (b.user_id = $2 and b.blocked_id = $1)),
+      exists(select true from friends f
+        where (f.user_id_1 = $1 and f.user_id_2 = $2)
+        or (f.user_id_1 = $2 and f.user_id_2 = $1))
+      from users u
+      where u.id = $2;
+  `
+	var accept string
+	var verified, blocked, friends bool
+	err := m.DB.QueryRow(stmt, senderId, receiverId).Scan(&accept, &verified, &blocked, &friends)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNoRecord
+		}
+		return false, err
+	}
+
+	switch {
+	case senderId == receiverId, blocked:
+		return false, nil
+	case friends:
+		return true, nil
+	default:
+		return verified && accept == AcceptAnyone, nil
+	}
+}
+
+func (m *PolicyModel) GetPrivacy(userId string) (*Privacy, error) {
+	privacy := &Privacy{}
+	stmt := "SELECT accept_messages FROM users WHERE id = $1"
+	err := m.DB.QueryRow(stmt, userId).Scan(&privacy.AcceptMessages)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return privacy, nil
+}
+
+func (m *PolicyModel) SetPrivacy(userId string, privacy Privacy) error {
+	stmt := "UPDATE users SET accept_messages = $2 WHERE id = $1"
+	_, err := m.DB.Exec(stmt, userId, privacy.AcceptMessages)
+	return err
+}
+
+// isMissingUser reports whether err is a foreign key violation, which means
+// one of the users doesn't exist.
+func isMissingUser(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// Block stops the two users from reaching each other. Their friendship and
+// any pending friend request between them are removed. ErrNoRecord is
+// returned if otherId doesn't exist.
+func (m *PolicyModel) Block(userId, otherId string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+    INSERT INTO user_blocks (user_id, blocked_id, created) VALUES ($1, $2, $3)
+    ON CONFLICT (user_id, blocked_id) DO NOTHING;
+  `
+	_, err = tx.Exec(stmt, userId, otherId, time.Now().UTC())
+	if err != nil {
+		if isMissingUser(err) {
+			return ErrNoRecord
+		}
+		return err
+	}
+
+	id1, id2 := friendPair(userId, otherId)
+	_, err = tx.Exec("DELETE FROM friends WHERE user_id_1 = $1 AND user_id_2 = $2", id1, id2)
+	if err != nil {
+		return err
+	}
+
+	stmt = `
+    DELETE FROM friend_requests
+    WHERE status = 'pending'
+    AND ((from_id = $1 AND to_id = $2) OR (from_id = $2 AND to_id = $1));
+  `
+	_, err = tx.Exec(stmt, userId, otherId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *PolicyModel) Unblock(userId, otherId string) error {
+	stmt := "DELETE FROM user_blocks WHERE user_id = $1 AND blocked_id = $2"
+	_, err := m.DB.Exec(stmt, userId, otherId)
+	return err
+}
+
+// IsBlocked reports whether either user blocked the other.
+func (m *PolicyModel) IsBlocked(userId, otherId string) (bool, error) {
+	var blocked bool
+	stmt := `
+    SELECT EXISTS(SELECT true FROM user_blocks
+    WHERE (user_id = $1 AND blocked_id = $2) OR (user_id = $2 AND blocked_id = $1))
+  `
+	err := m.DB.QueryRow(stmt, userId, otherId).Scan(&blocked)
+	return blocked, err
+}
+
+// HasBlocked reports whether userId blocked otherId.
+func (m *PolicyModel) HasBlocked(userId, otherId string) (bool, error) {
+	var blocked bool
+	stmt := "SELECT EXISTS(SELECT true FROM user_blocks WHERE user_id = $1 AND blocked_id = $2)"
+	err := m.DB.QueryRow(stmt, userId, otherId).Scan(&blocked)
+	return blocked, err
+}
+
+// BlockedUsers returns the users userId blocked.
+func (m *PolicyModel) BlockedUsers(userId string) ([]*User, error) {
+	stmt := `
+    SELECT u.id, u.name, u.avatar
+    FROM user_blocks b
+    JOIN users u ON u.id = b.blocked_id
+    WHERE b.user_id = $1
+    ORDER BY u.name;
+  `
+	rows, err := m.DB.Query(stmt, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	users := []*User{}
+
+	for rows.Next() {
+		user := &User{}
+		err := rows.Scan(&user.ID, &user.Name, &user.AvatarUrl)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Mute keeps messages from otherId coming in for userId without counting them
+// as unread or notifying about them. ErrNoRecord is returned if otherId
+// doesn't exist.
+func (m *PolicyModel) Mute(userId, otherId string) error {
+	stmt := `
+    INSERT INTO user_mutes (user_id, muted_id, created) VALUES ($1, $2, $3)
+    ON CONFLICT (user_id, muted_id) DO NOTHING;
+  `
+	_, err := m.DB.Exec(stmt, userId, otherId, time.Now().UTC())
+	if isMissingUser(err) {
+		return ErrNoRecord
+	}
+	return err
+}
+
+func (m *PolicyModel) Unmute(userId, otherId string) error {
+	stmt := "DELETE FROM user_mutes WHERE user_id = $1 AND muted_id = $2"
+	_, err := m.DB.Exec(stmt, userId, otherId)
+	return err
+}
+
+// IsMuted reports whether userId muted otherId.
+func (m *PolicyModel) IsMuted(userId, otherId string) (bool, error) {
+	var muted bool
+	stmt := "SELECT EXISTS(SELECT true FROM user_mutes WHERE user_id = $1 AND muted_id = $2)"
+	err := m.DB.QueryRow(stmt, userId, otherId).Scan(&muted)
+	return muted, err
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Snippets returned by search wrap the matching words in these markers. They
+// are control characters so they can't clash with anything in a message and
+// the caller decides how to escape and highlight the snippet.
+const (
+	HighlightStart = "\x02"
+	HighlightStop  = "\x03"
+)
+
+const (
+	SearchDirect = "direct"
+	SearchGroup  = "group"
+)
+
+type SearchResult struct {
+	Kind             string    `json:"kind"` // SearchDirect or SearchGroup
+	MessageID        string    `json:"message_id"`
+	ConversationID   string    `json:"conversation_id"` // the other user or the group
+	ConversationName string    `json:"conversation_name"`
+	Sender           string    `json:"sender"`
+	Snippet          string    `json:"snippet"`
+	Created          time.Time `json:"created"`
+}
+
+type SearchModel struct {
+	DB *sql.DB
+}
+
+// Search looks for messages matching query in every direct conversation and
+// group userId takes part in, best matches first. The query uses the web
+// search syntax: quoted phrases, "or" and -excluded words.
+func (m *SearchModel) Search(userId, query string, limit, offset int) ([]*SearchResult, error) {
+	stmt := `
+      select kind, id, conversation_id, conversation_name, sender,
+      ts_headline('english', body, websearch_to_tsquery('english', $2), $3) as snippet,
+      created
+      from (
+        select 'direct' as kind, dm.id, dm.body, dm.created, s.name as sender,
+        case when dm.from_id = $1 then dm.to_id else dm.from_id end as conversation_id,
+        case when dm.from_id = $1 then r.name else s.name end as conversation_name,
+        ts_rank(dm.body_tsv, q) as rank
+        from direct_message dm
+        join users s on s.id = dm.from_id
+        join users r on r.id = dm.to_id,
+        websearch_to_tsquery('english', $2) q
+        where (dm.from_id = $1 or dm.to_id = $1)
+        and dm.deleted is null
+        and dm.body_tsv @@ q
+
+        union all
+
+        select 'group', gm.id, gm.body, gm.created, s.name,
+        gm.group_id, g.name,
+        ts_rank(gm.body_tsv, q)
+        from group_message gm
+        join group_members mem on mem.group_id = gm.group_id and mem.user_id = $1
+        join groups g on g.id = gm.group_id
+        join users s on s.id = gm.from_id,
+        websearch_to_tsquery('english', $2) q
+        where gm.body_tsv @@ q
+      ) results
+      order by rank desc, created desc
+      limit $4 offset $5;
+  `
+	options := "StartSel=" + HighlightStart + ", StopSel=" + HighlightStop + ", MaxFragments=2, MaxWords=20, MinWords=5"
+	rows, err := m.DB.Query(stmt, userId, query, options, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	results := []*SearchResult{}
+
+	for rows.Next() {
+		res := &SearchResult{}
+		err := rows.Scan(&res.Kind, &res.MessageID, &res.ConversationID, &res.ConversationName, &res.Sender, &res.Snippet, &res.Created)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// sessionTouchInterval keeps every request from writing to the table, last
+// seen is only moved forward when it is older than this.
+const sessionTouchInterval = time.Minute
+
+// Session is a browser a user is logged in with.
+type Session struct {
+	ID        uuid.UUID
+	UserID    string
+	UserAgent string
+	IP        string
+	Created   time.Time
+	LastSeen  time.Time
+}
+
+// SessionModelInterface is what the handlers use of SessionModel, tests
+// replace it with one that doesn't need a database.
+type SessionModelInterface interface {
+	Create(userId, userAgent, ip string) (string, error)
+	Touch(id, userId, ip string) error
+	Sessions(userId string) ([]*Session, error)
+	Revoke(id, userId string) error
+	RevokeAll(userId string, keep ...string) ([]string, error)
+}
+
+type SessionModel struct {
+	DB *sql.DB
+	// Lifetime is how long the session cookie lasts, older sessions are
+	// expired and not listed anymore.
+	Lifetime time.Duration
+}
+
+// Create records a new login and returns the id of the session. The expired
+// sessions of the user are cleaned up on the way.
+func (m *SessionModel) Create(userId, userAgent, ip string) (string, error) {
+	id := uuid.New()
+	now := time.Now().UTC()
+
+	_, err := m.DB.Exec("DELETE FROM user_sessions WHERE user_id = $1 AND created < $2", userId, now.Add(-m.Lifetime))
+	if err != nil {
+		return "", err
+	}
+
+	stmt := `
+    INSERT INTO user_sessions (id, user_id, user_agent, ip, created, last_seen)
+    VALUES ($1, $2, $3, $4, $5, $5);
+  `
+	_, err = m.DB.Exec(stmt, id, userId, userAgent, ip, now)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// Touch records activity on a session of userId from ip. ErrNoRecord is
+// returned if the session was revoked, or was never recorded.
+func (m *SessionModel) Touch(id, userId, ip string) error {
+	if id == "" {
+		return ErrNoRecord
+	}
+	now := time.Now().UTC()
+	stmt := `
+    WITH touched AS (
+      UPDATE user_sessions SET last_seen = $3, ip = $4
+      WHERE id = $1 AND user_id = $2 AND last_seen < $5
+    )
+    SELECT EXISTS (SELECT 1 FROM user_sessions WHERE id = $1 AND user_id = $2);
+  `
+	var exists bool
+	err := m.DB.QueryRow(stmt, id, userId, now, ip, now.Add(-sessionTouchInterval)).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// Sessions returns the sessions of userId that haven't expired, the most
+// recently used first.
+func (m *SessionModel) Sessions(userId string) ([]*Session, error) {
+	stmt := `
+    SELECT id, user_id, user_agent, ip, created, last_seen FROM user_sessions
+    WHERE user_id = $1 AND created >= $2
+    ORDER BY last_seen DESC;
+  `
+	rows, err := m.DB.Query(stmt, userId, time.Now().UTC().Add(-m.Lifetime))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	sessions := []*Session{}
+
+	for rows.Next() {
+		s := &Session{}
+		err := rows.Scan(&s.ID, &s.UserID, &s.UserAgent, &s.IP, &s.Created, &s.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Revoke ends a session of userId, ErrNoRecord is returned if it doesn't
+// have one with that id.
+func (m *SessionModel) Revoke(id, userId string) error {
+	stmt := "DELETE FROM user_sessions WHERE id = $1 AND user_id = $2"
+	res, err := m.DB.Exec(stmt, id, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// RevokeAll ends every session of userId but the ones in keep and returns the
+// ids of the sessions it ended.
+func (m *SessionModel) RevokeAll(userId string, keep ...string) ([]string, error) {
+	if keep == nil {
+		keep = []string{}
+	}
+	stmt := `
+    DELETE FROM user_sessions
+    WHERE user_id = $1 AND NOT (id::text = ANY($2))
+    RETURNING id;
+  `
+	rows, err := m.DB.Query(stmt, userId, pq.Array(keep))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	ids := []string{}
+
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/Tsundere-Musume/message/internal/migrate"
+)
+
+// newTestDB connects to the database named by MESSAGE_TEST_DSN, migrates it up
+// and rolls every migration back when the test is done, so it must be a
+// database of its own. Tests using it are skipped without one.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("MESSAGE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("MESSAGE_TEST_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := migrate.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrator.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		defer db.Close()
+		_, err := migrator.Down(context.Background(), math.MaxInt)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	return db
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Tsundere-Musume/message/internal/totp"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets when enabling two
+// factor authentication.
+const recoveryCodeCount = 10
+
+// TwoFactorModelInterface is what the handlers use of TwoFactorModel, tests
+// replace it with one that doesn't need a database.
+type TwoFactorModelInterface interface {
+	Enabled(userId string) (bool, error)
+	Enable(userId string, secret []byte, step int64) ([]string, error)
+	Disable(userId string) error
+	Check(userId, code string) (bool, error)
+	RecoveryCodesLeft(userId string) (int, error)
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// Enabled reports whether userId logs in with a second factor.
+func (m *TwoFactorModel) Enabled(userId string) (bool, error) {
+	var enabled bool
+	stmt := "SELECT EXISTS(SELECT true FROM user_totp WHERE user_id = $1)"
+	err := m.DB.QueryRow(stmt, userId).Scan(&enabled)
+	return enabled, err
+}
+
+// Enable turns two factor authentication on with secret once the user proved
+// their app works with a code of step. It returns new recovery codes, only
+// their hashes are kept.
+func (m *TwoFactorModel) Enable(userId string, secret []byte, step int64) ([]string, error) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+    INSERT INTO user_totp (user_id, secret, last_step, enabled) VALUES ($1, $2, $3, $4)
+    ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_step = $3, enabled = $4;
+  `
+	_, err = tx.Exec(stmt, userId, secret, step, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userId, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// Disable turns two factor authentication off and drops the recovery codes.
+func (m *TwoFactorModel) Disable(userId string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM user_totp WHERE user_id = $1", userId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Check reports whether code is a current code of the authenticator app of
+// userId or one of their unused recovery codes. Either can only be used once.
+func (m *TwoFactorModel) Check(userId, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) > 7 {
+		return m.useRecoveryCode(userId, code)
+	}
+
+	var secret []byte
+	err := m.DB.QueryRow("SELECT secret FROM user_totp WHERE user_id = $1", userId).Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNoRecord
+		}
+		return false, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	// a code seen before, or an older one, could have been watched
+	res, err := m.DB.Exec("UPDATE user_totp SET last_step = $2 WHERE user_id = $1 AND last_step < $2", userId, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (m *TwoFactorModel) useRecoveryCode(userId, code string) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	res, err := m.DB.Exec("DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2", userId, hashToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RecoveryCodesLeft returns how many recovery codes userId hasn't used.
+func (m *TwoFactorModel) RecoveryCodesLeft(userId string) (int, error) {
+	var count int
+	err := m.DB.QueryRow("SELECT count(*) FROM recovery_codes WHERE user_id = $1", userId).Scan(&count)
+	return count, err
+}
+
+// newRecoveryCodes returns random codes like 7kq2-m4xa-9fbt-c3ne.
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totp.Encoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode lets codes be typed without the dashes and in any case.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
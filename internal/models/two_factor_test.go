@@ -0,0 +1,73 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Tsundere-Musume/message/internal/totp"
+)
+
+func TestTwoFactorCheck(t *testing.T) {
+	db := newTestDB(t)
+	users := &UserModel{DB: db}
+	m := &TwoFactorModel{DB: db}
+
+	userId, err := users.Insert("Alice", "alice@example.com", "pa55word", "default_img.jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Check(userId.String(), "123456")
+	if !errors.Is(err, ErrNoRecord) {
+		t.Fatalf("got error %v before enabling, want %v", err, ErrNoRecord)
+	}
+
+	// keep the whole test within one time step
+	if left := 30 - time.Now().Unix()%30; left < 5 {
+		time.Sleep(time.Duration(left+1) * time.Second)
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := totp.Step(time.Now())
+	recovery, err := m.Enable(userId.String(), secret, now-2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{name: "outside the skew window", code: totp.Code(secret, now-3), want: false},
+		{name: "one step late", code: totp.Code(secret, now-1), want: true},
+		{name: "replayed", code: totp.Code(secret, now-1), want: false},
+		{name: "current", code: totp.Code(secret, now), want: true},
+		{name: "older than the last used", code: totp.Code(secret, now-1), want: false},
+		{name: "one step early", code: totp.Code(secret, now+1), want: true},
+		{name: "replayed early", code: totp.Code(secret, now+1), want: false},
+		{name: "recovery code", code: recovery[0], want: true},
+		{name: "used recovery code", code: recovery[0], want: false},
+		{name: "recovery code without dashes", code: "  " + recovery[1][:4] + recovery[1][5:] + " ", want: true},
+	}
+
+	for _, tt := range tests {
+		ok, err := m.Check(userId.String(), tt.code)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ok != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+
+	left, err := m.RecoveryCodesLeft(userId.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != len(recovery)-2 {
+		t.Errorf("got %d recovery codes left, want %d", left, len(recovery)-2)
+	}
+}
@@ -17,30 +17,35 @@ type User struct {
 	HashedPassword string
 	AvatarUrl      string
 	CreatedAt      time.Time
+	LastSeen       time.Time
+	Verified       bool // the user proved they own the email address
 }
 
 type UserModel struct {
 	DB *sql.DB
 }
 
-func (m *UserModel) Insert(name, email, password, avatar string) error {
+// Insert creates an account with an unverified email address and returns its
+// id.
+func (m *UserModel) Insert(name, email, password, avatar string) (uuid.UUID, error) {
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 	if err != nil {
-		return err
+		return uuid.UUID{}, err
 	}
 	stmt := `
 	INSERT INTO users (id, name, email,avatar,  hashed_password, created) 
 	VALUES ($1, $2, $3, $4, $5, $6);
 	`
-	_, err = m.DB.Exec(stmt, uuid.New(), name, email, avatar, hashedPassword, time.Now().UTC())
+	id := uuid.New()
+	_, err = m.DB.Exec(stmt, id, name, email, avatar, hashedPassword, time.Now().UTC())
 	if err != nil {
 		if strings.Contains(err.Error(), "users_email_key") {
-			return ErrDuplicateEmail
+			return uuid.UUID{}, ErrDuplicateEmail
 		}
-		return err
+		return uuid.UUID{}, err
 	}
-	return nil
+	return id, nil
 }
 
 func (m *UserModel) Authenticate(email, password string) (uuid.UUID, error) {
@@ -68,6 +73,25 @@ func (m *UserModel) Authenticate(email, password string) (uuid.UUID, error) {
 	return id, nil
 }
 
+// CheckPassword returns ErrInvalidCredentials unless password is the password
+// of the user, for confirming sensitive changes.
+func (m *UserModel) CheckPassword(id, password string) error {
+	var hashedPassword []byte
+	err := m.DB.QueryRow("SELECT hashed_password FROM users WHERE id = $1", id).Scan(&hashedPassword)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+
+	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
 func (m *UserModel) Exists(id string) (bool, error) {
 	var exists bool
 
@@ -79,8 +103,8 @@ func (m *UserModel) Exists(id string) (bool, error) {
 
 func (m *UserModel) Get(id string) (*User, error) {
 	var user User
-	stmt := "SELECT name, email, created, avatar FROM users WHERE id = $1"
-	err := m.DB.QueryRow(stmt, id).Scan(&user.Name, &user.Email, &user.CreatedAt, &user.AvatarUrl)
+	stmt := "SELECT id, name, email, created, avatar, email_verified IS NOT NULL FROM users WHERE id = $1"
+	err := m.DB.QueryRow(stmt, id).Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.AvatarUrl, &user.Verified)
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") {
 			return nil, ErrNoRecord
@@ -90,35 +114,107 @@ func (m *UserModel) Get(id string) (*User, error) {
 	return &user, nil
 }
 
-func (m *UserModel) GetAllUsers(id string) ([]*User, error) {
-	//TODO: maybe remove the email probably should remove better to remove
-	stmt := "SELECT id, name, email, created, avatar FROM users WHERE id != $1"
-	rows, err := m.DB.Query(stmt, id)
+// IsVerified reports whether the user verified their email address. It
+// returns ErrNoRecord if there is no such user.
+func (m *UserModel) IsVerified(id string) (bool, error) {
+	var verified bool
+	stmt := "SELECT email_verified IS NOT NULL FROM users WHERE id = $1"
+	err := m.DB.QueryRow(stmt, id).Scan(&verified)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNoRecord
+		}
+		return false, err
+	}
+	return verified, nil
+}
+
+// Verify marks the email address of the user as verified. Nothing changes if
+// the address isn't email anymore.
+func (m *UserModel) Verify(id, email string) error {
+	stmt := "UPDATE users SET email_verified = $3 WHERE id = $1 AND email = $2 AND email_verified IS NULL"
+	_, err := m.DB.Exec(stmt, id, email, time.Now().UTC())
+	return err
+}
+
+// GetByEmail returns the user with the email address, emails are compared
+// the way Authenticate compares them.
+func (m *UserModel) GetByEmail(email string) (*User, error) {
+	user := &User{Email: email}
+	stmt := "SELECT id, name, created, avatar, email_verified IS NOT NULL FROM users WHERE email = $1"
+	err := m.DB.QueryRow(stmt, email).Scan(&user.ID, &user.Name, &user.CreatedAt, &user.AvatarUrl, &user.Verified)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// DirectoryEntry is a user listed in the directory with how they relate to
+// the user browsing it.
+type DirectoryEntry struct {
+	User      *User
+	Friend    bool
+	Requested bool // the browsing user sent them a friend request
+	Incoming  bool // they sent the browsing user a friend request
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Directory lists the users userId can find, names starting with query first
+// and then names similar to it. An empty query lists everyone by name. Users
+// that blocked each other don't see each other.
+func (m *UserModel) Directory(userId, query string, limit, offset int) ([]*DirectoryEntry, error) {
+	stmt := `
+      select u.id, u.name, u.avatar,
+      exists(select true from friends f
+        where (f.user_id_1 = $1 and f.user_id_2 = u.id)
+        or (f.user_id_1 = u.id and f.user_id_2 = $1)),
+      exists(select true from friend_requests r
+        where r.from_id = $1 and r.to_id = u.id and r.status = 'pending'),
+      exists(select true from friend_requests r
+        where r.from_id = u.id and r.to_id = $1 and r.status = 'pending')
+      from users u
+      where u.id != $1
+      and not exists(select true from user_blocks b
+        where (b.user_id = $1 and b.blocked_id = u.id)
+        or (b.user_id = u.id and b.blocked_id = $1))
+      and ($2 = '' or lower(u.name) like lower($3) or lower(u.name) % lower($2))
+      order by lower(u.name) like lower($3) desc,
+      similarity(lower(u.name), lower($2)) desc,
+      lower(u.name), u.id
+      limit $4 offset $5;
+  `
+	prefix := likeEscaper.Replace(query) + "%"
+	rows, err := m.DB.Query(stmt, userId, query, prefix, limit, offset)
 	if err != nil {
 		return nil, err
 	}
 
 	defer rows.Close()
-	users := []*User{}
+	entries := []*DirectoryEntry{}
 
 	for rows.Next() {
-		user := &User{}
-		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.AvatarUrl)
+		entry := &DirectoryEntry{User: &User{}}
+		err := rows.Scan(&entry.User.ID, &entry.User.Name, &entry.User.AvatarUrl, &entry.Friend, &entry.Requested, &entry.Incoming)
 		if err != nil {
 			return nil, err
 		}
-		users = append(users, user)
+		entries = append(entries, entry)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return users, nil
+	return entries, nil
 }
 
 func (m *UserModel) GetFriends(id string) ([]*User, error) {
 	//TODO: maybe remove the email probably should remove better to remove
 	stmt := `
-    SELECT u.id, u.name, u.avatar
+    SELECT u.id, u.name, u.avatar, u.last_seen
     FROM 
         friends f
     JOIN 
@@ -135,10 +231,12 @@ func (m *UserModel) GetFriends(id string) ([]*User, error) {
 
 	for rows.Next() {
 		user := &User{}
-		err := rows.Scan(&user.ID, &user.Name, &user.AvatarUrl)
+		var lastSeen sql.NullTime
+		err := rows.Scan(&user.ID, &user.Name, &user.AvatarUrl, &lastSeen)
 		if err != nil {
 			return nil, err
 		}
+		user.LastSeen = lastSeen.Time
 		users = append(users, user)
 	}
 	if err = rows.Err(); err != nil {
@@ -147,11 +245,10 @@ func (m *UserModel) GetFriends(id string) ([]*User, error) {
 	return users, nil
 }
 
-func (m *UserModel) AddFriend(userId, otherId string) error {
+func (m *UserModel) RemoveFriend(userId, otherId string) error {
 	stmt := `
-    INSERT INTO FRIENDS (user_id_1, user_id_2)
-    VALUES ($1, $2)
-    ON CONFLICT (user_id_1, user_id_2) DO NOTHING;
+    DELETE FROM FRIENDS 
+    WHERE user_id_1 = $1 AND user_id_2 = $2;
   `
 	var err error
 	if userId < otherId {
@@ -162,16 +259,21 @@ func (m *UserModel) AddFriend(userId, otherId string) error {
 	return err
 }
 
-func (m *UserModel) RemoveFriend(userId, otherId string) error {
-	stmt := `
-    DELETE FROM FRIENDS 
-    WHERE user_id_1 = $1 AND user_id_2 = $2;
-  `
+func (m *UserModel) IsFriend(userId, otherId string) (bool, error) {
+	var exists bool
+
+	stmt := "SELECT EXISTS(SELECT true FROM friends WHERE user_id_1 = $1 AND user_id_2 = $2)"
 	var err error
 	if userId < otherId {
-		_, err = m.DB.Exec(stmt, userId, otherId)
+		err = m.DB.QueryRow(stmt, userId, otherId).Scan(&exists)
 	} else {
-		_, err = m.DB.Exec(stmt, otherId, userId)
+		err = m.DB.QueryRow(stmt, otherId, userId).Scan(&exists)
 	}
+	return exists, err
+}
+
+func (m *UserModel) UpdateLastSeen(id string, t time.Time) error {
+	stmt := "UPDATE users SET last_seen = $2 WHERE id = $1"
+	_, err := m.DB.Exec(stmt, id, t)
 	return err
 }
@@ -0,0 +1,86 @@
+// Package totp implements the time based one-time passwords of RFC 6238 with
+// the defaults authenticator apps expect: HMAC-SHA1, 30 second steps and six
+// digits.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	period = 30
+	digits = 6
+	// skew is how many steps a code may be early or late, for clocks that
+	// are a little off.
+	skew = 1
+)
+
+// Encoding is how secrets are shown to users and put in otpauth urls.
+var Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random 160 bit secret, the size RFC 4226 recommends.
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Step returns the time step t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / period
+}
+
+// Code returns the code of secret for a time step.
+func Code(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1_000_000)
+}
+
+// Validate checks code against the steps around t and returns the step it
+// belongs to, so the caller can refuse to accept a step twice.
+func Validate(secret []byte, code string, t time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != digits {
+		return 0, false
+	}
+	now := Step(t)
+	for step := now - skew; step <= now+skew; step++ {
+		if hmac.Equal([]byte(Code(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth url authenticator apps read from QR codes.
+func URI(issuer, account string, secret []byte) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+		RawQuery: url.Values{
+			"secret": {Encoding.EncodeToString(secret)},
+			"issuer": {issuer},
+		}.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,70 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret of the RFC 6238 test vectors.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B, the vectors have eight digits and the codes are
+	// their last six
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		if got := Code(rfcSecret, Step(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("%d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current", code: Code(rfcSecret, step), wantStep: step, wantOK: true},
+		{name: "with spaces", code: "005 924", wantStep: step, wantOK: true},
+		{name: "one step late", code: Code(rfcSecret, step-1), wantStep: step - 1, wantOK: true},
+		{name: "one step early", code: Code(rfcSecret, step+1), wantStep: step + 1, wantOK: true},
+		{name: "two steps late", code: Code(rfcSecret, step-2)},
+		{name: "two steps early", code: Code(rfcSecret, step+2)},
+		{name: "wrong", code: "000000"},
+		{name: "too short", code: "05924"},
+		{name: "too long", code: "0059240"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.wantOK || got != tt.wantStep {
+				t.Errorf("got %d, %v, want %d, %v", got, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("Message", "alice@example.com", rfcSecret)
+	want := "otpauth://totp/Message:alice@example.com?issuer=Message&secret=" + Encoding.EncodeToString(rfcSecret)
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -1,6 +1,11 @@
 package validator
 
-import "regexp"
+import (
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
 
 // TODO: use better validaiton
 var EmailRX = regexp.MustCompile("^[a-zA-Z0-9\\.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
@@ -44,3 +49,11 @@ func Matches(value string, rx *regexp.Regexp) bool {
 func MinChars(value string, length int) bool {
 	return len(value) >= length
 }
+
+func MaxChars(value string, length int) bool {
+	return utf8.RuneCountInString(value) <= length
+}
+
+func IsUUID(value string) bool {
+	return uuid.Validate(value) == nil
+}
@@ -0,0 +1,135 @@
+(() => {
+  // events.js keeps a connection to /events open on pages that are not tied
+  // to a conversation and applies the account wide events it receives.
+  const protocolVersion = 1;
+  const subprotocol = `message.v${protocolVersion}`;
+  const statusClasses = { online: "bg-foam", away: "bg-gold", offline: "bg-muted" };
+
+  let conn;
+  const scheme = location.protocol === "https:" ? "wss" : "ws";
+
+  function dial() {
+    conn = new WebSocket(`${scheme}://${location.host}/events`, [subprotocol]);
+
+    conn.addEventListener("close", (ev) => {
+      console.info(`events disconnected code: ${ev.code}, reason: ${ev.reason}`);
+      // 4001: this session was logged out from elsewhere
+      if (ev.code === 4001) {
+        location.assign("/user/login");
+        return;
+      }
+      // 1001: server going away, 1002: protocol version rejected
+      if (ev.code !== 1001 && ev.code !== 1002) {
+        setTimeout(dial, 1000);
+      }
+    });
+    conn.addEventListener("open", () => {
+      sendStatus();
+    });
+
+    conn.addEventListener("message", (ev) => {
+      if (typeof ev.data !== "string") {
+        console.error("unexpected message type", typeof ev.data);
+        return;
+      }
+      const e = JSON.parse(ev.data);
+      if (e.version !== protocolVersion) {
+        console.error("unsupported protocol version", e.version);
+        return;
+      }
+      switch (e.type) {
+        case "presence":
+          updatePresence(e.payload);
+          break;
+        case "conversation.updated":
+          bumpConversation(e.payload);
+          break;
+        case "friend.request":
+          countFriendRequest();
+          break;
+        case "friend.accepted":
+          console.info(`${e.payload.name} accepted your friend request`);
+          break;
+        case "error":
+          console.error("server error:", e.payload.error, e.payload.ref);
+          break;
+      }
+    });
+  }
+
+  function frameId() {
+    if (crypto.randomUUID) {
+      return crypto.randomUUID();
+    }
+    return `${Date.now()}-${Math.random().toString(16).slice(2)}`;
+  }
+
+  function sendFrame(type, payload) {
+    if (!conn || conn.readyState !== WebSocket.OPEN) {
+      return;
+    }
+    conn.send(
+      JSON.stringify({ type, version: protocolVersion, id: frameId(), payload }),
+    );
+  }
+
+  function sendStatus() {
+    sendFrame("presence", { status: document.hidden ? "away" : "online" });
+  }
+
+  function updatePresence(p) {
+    for (const dot of document.querySelectorAll(`[data-presence="${CSS.escape(p.user_id)}"]`)) {
+      dot.classList.remove(...Object.values(statusClasses));
+      dot.classList.add(statusClasses[p.status] || statusClasses.offline);
+      dot.title = `last seen ${new Date(p.last_seen).toLocaleString()}`;
+    }
+  }
+
+  // bumpConversation moves a conversation to the top of the list and shows its
+  // new latest message.
+  function bumpConversation(c) {
+    const list = document.getElementById("conversation-list");
+    const item = list?.querySelector(`[data-conversation="${CSS.escape(c.peer_id)}"]`);
+    if (!item) {
+      return;
+    }
+    const m = c.message;
+
+    const preview = item.querySelector(".conversation-preview");
+    preview.className = "conversation-preview text-text truncate";
+    preview.replaceChildren();
+    const sender = document.createElement("span");
+    sender.className = "text-muted";
+    sender.innerText = `${m.sender}:`;
+    preview.append(sender, ` ${m.body}`);
+
+    item.querySelector(".conversation-time").innerText = new Date(m.created).toLocaleTimeString();
+
+    if (m.from_id === c.peer_id && !c.muted) {
+      let badge = item.querySelector(".unread-badge");
+      if (!badge) {
+        badge = document.createElement("span");
+        badge.className = "unread-badge ml-2 bg-love text-base text-sm rounded-full px-2";
+        badge.dataset.unread = c.peer_id;
+        badge.innerText = "0";
+        item.querySelector(".conversation-time").after(badge);
+      }
+      badge.innerText = `${Number(badge.innerText) + 1}`;
+    }
+
+    list.prepend(item);
+  }
+
+  // countFriendRequest bumps every pending friend request counter on the page.
+  function countFriendRequest() {
+    for (const el of document.querySelectorAll("[data-friend-requests]")) {
+      const count = Number(el.dataset.friendRequests) + 1;
+      el.dataset.friendRequests = `${count}`;
+      el.innerText = el.innerText.replace(/^\d+/, `${count}`);
+      el.classList.remove("hidden");
+    }
+  }
+
+  document.addEventListener("visibilitychange", sendStatus);
+  dial();
+})();
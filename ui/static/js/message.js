@@ -1,22 +1,53 @@
 (() => {
+  // group pages point the socket at their own endpoint, direct messages
+  // fall back to the receiver id in the url.
+  const root = document.getElementById("root");
+  const recId = location.pathname.split("/");
+  const subscribePath =
+    root.dataset.subscribe || `/subscribe/${recId[recId.length - 1]}`;
+  // only direct message pages support editing and deleting messages
+  const messagesPath = root.dataset.messages;
+  // conversations the user may no longer write to are shown without a
+  // connection, the server would refuse it anyway.
+  const readonly = root.dataset.readonly !== undefined;
+
+  // every frame is wrapped in a versioned envelope, the version is also
+  // negotiated through the websocket subprotocol.
+  const protocolVersion = 1;
+  const subprotocol = `message.v${protocolVersion}`;
+
+  // conn is the current connection, messages are sent over it as frames.
+  let conn;
+  const scheme = location.protocol === "https:" ? "wss" : "ws";
+
   function dial() {
-    const recId = location.pathname.split("/");
-    const conn = new WebSocket(
-      `ws://${location.host}/subscribe/${recId[recId.length - 1]}`,
-    );
+    conn = new WebSocket(`${scheme}://${location.host}${subscribePath}`, [subprotocol]);
 
     conn.addEventListener("close", (ev) => {
       appendLog(
         `WebSocket Disconnected code: ${ev.code}, reason: ${ev.reason}`,
         true,
       );
-      if (ev.code !== 1001) {
+      // 4002: the conversation was blocked, 4003: removed from the group
+      if (ev.code === 4002 || ev.code === 4003) {
+        appendLog(ev.reason, true);
+        return;
+      }
+      // 4001: this session was logged out from elsewhere
+      if (ev.code === 4001) {
+        location.assign("/user/login");
+        return;
+      }
+      // 1001: server going away, 1002: protocol version rejected
+      if (ev.code !== 1001 && ev.code !== 1002) {
         appendLog("Reconnecting in 1s", true);
         setTimeout(dial, 1000);
       }
     });
     conn.addEventListener("open", (ev) => {
       console.info("websocket connected");
+      sendStatus();
+      ackLatest();
     });
 
     // This is where we handle messages received.
@@ -25,23 +56,60 @@
         console.error("unexpected message type", typeof ev.data);
         return;
       }
-      const m = JSON.parse(ev.data);
-      console.log(m);
-      const p = appendLog(m);
-      p.scrollIntoView();
-      p.scrollTop = p.scrollHeight;
+      const e = JSON.parse(ev.data);
+      if (e.version !== protocolVersion) {
+        console.error("unsupported protocol version", e.version);
+        return;
+      }
+      switch (e.type) {
+        case "message.created": {
+          stopTyping(e.payload.from_id);
+          const p = appendLog(e.payload);
+          p.scrollIntoView();
+          p.scrollTop = p.scrollHeight;
+          ackLatest();
+          break;
+        }
+        case "message.read":
+          markSeen(e.payload);
+          break;
+        case "message.edited":
+          markEdited(e.payload);
+          break;
+        case "message.deleted":
+          markDeleted(e.payload);
+          break;
+        case "typing":
+          showTyping(e.payload);
+          break;
+        case "presence":
+          updatePresence(e.payload);
+          break;
+        case "conversation.updated":
+          // only the conversation list cares about these
+          break;
+        case "error":
+          console.error("server error:", e.payload.error, e.payload.ref);
+          restoreRejected(e.payload);
+          break;
+        default:
+          console.warn("unknown event type", e.type);
+      }
     });
   }
-  dial();
+  if (!readonly) {
+    dial();
+  }
 
   const messageLog = document.getElementById("message-log");
   const publishForm = document.getElementById("publish-form");
   const messageInput = document.getElementById("message-input");
-  const timeZone = Intl.DateTimeFormat().resolvedOptions().timeZone;
 
   function createMessage(m){
     const msgWrapper = document.createElement("div")
     msgWrapper.className = "flex items-start mb-4 p-3 rounded-lg shadow-md"
+    msgWrapper.dataset.id = m.id
+    msgWrapper.dataset.from = m.from_id
 
     const profileImage = document.createElement("div")
     profileImage.className = "w-10 h-10 bg-gray-400 rounded-full flex-shrink-0 mr-3"
@@ -60,20 +128,273 @@
 
     usernameContainer.append(username)
 
+    if (messagesPath && m.from_id === userID && !m.deleted) {
+      usernameContainer.append(createActions())
+    }
+
     msgBody.append(usernameContainer)
 
     const msg= document.createElement("p")
-    msg.className = "text-text"
+    msg.className = "msg-body text-text"
     msg.innerText = m.body
     msgBody.append(msg)
 
     msgWrapper.append(msgBody)
     return msgWrapper
   }
+  function createActions(){
+    const actions = document.createElement("span")
+    actions.className = "msg-actions ml-auto text-sm"
+
+    const edit = document.createElement("button")
+    edit.className = "text-foam"
+    edit.dataset.action = "edit"
+    edit.innerText = "edit"
+
+    const del = document.createElement("button")
+    del.className = "text-love"
+    del.dataset.action = "delete"
+    del.innerText = "delete"
+
+    actions.append(edit, del)
+    return actions
+  }
+
+  function findMessage(id){
+    return messageLog.querySelector(`[data-id="${CSS.escape(id)}"]`)
+  }
+
+  // markEdited updates an already rendered message in place.
+  function markEdited(m){
+    const el = findMessage(m.id)
+    if (!el) {
+      return
+    }
+    el.querySelector(".msg-body").innerText = m.body
+    if (!el.querySelector(".msg-edited")) {
+      const edited = document.createElement("span")
+      edited.className = "msg-edited text-muted text-sm"
+      edited.innerText = "(edited)"
+      el.querySelector(".msg-body").after(edited)
+    }
+  }
+
+  // markDeleted replaces the message with a tombstone.
+  function markDeleted(m){
+    const el = findMessage(m.id)
+    if (!el) {
+      return
+    }
+    const body = el.querySelector(".msg-body")
+    body.className = "msg-body text-muted italic"
+    body.innerText = "message deleted"
+    el.querySelector(".msg-edited")?.remove()
+    el.querySelector(".msg-actions")?.remove()
+  }
+
+  async function postAction(path, fields){
+    const formData = new FormData();
+    formData.append("csrf_token", document.querySelector("[name=csrf_token]").value);
+    for (const [k, v] of Object.entries(fields)) {
+      formData.append(k, v);
+    }
+    const resp = await fetch(path, { method: "POST", body: formData });
+    if (resp.status !== 202) {
+      throw new Error(`Unexpected HTTP Status ${resp.status} ${resp.statusText}`);
+    }
+  }
+
+  messageLog.addEventListener("click", async (ev) => {
+    const action = ev.target.dataset.action
+    if (!messagesPath || !action) {
+      return
+    }
+    const el = ev.target.closest("[data-id]")
+    const id = el.dataset.id
+    try {
+      if (action === "edit") {
+        const body = prompt("Edit message", el.querySelector(".msg-body").innerText)
+        if (body === null || body === "") {
+          return
+        }
+        await postAction(`${messagesPath}/${id}/edit`, { message: body })
+      } else if (action === "delete") {
+        if (!confirm("Delete this message?")) {
+          return
+        }
+        await postAction(`${messagesPath}/${id}/delete`, {})
+      }
+    } catch (err) {
+      console.error(`${action} failed: ${err.message}`)
+    }
+  })
+
+  // typing indicators expire on their own unless the user keeps typing.
+  const typingIndicator = document.getElementById("typing-indicator");
+  const typingTimeout = 4000;
+  const typingInterval = 2000;
+  const typingUsers = new Map();
+
+  function renderTyping(){
+    const names = [...typingUsers.values()].map((t) => t.name)
+    if (names.length === 0) {
+      typingIndicator.innerText = ""
+    } else if (names.length === 1) {
+      typingIndicator.innerText = `${names[0]} is typing…`
+    } else {
+      typingIndicator.innerText = `${names.join(", ")} are typing…`
+    }
+  }
+
+  function showTyping(t){
+    const prev = typingUsers.get(t.user_id)
+    if (prev) {
+      clearTimeout(prev.timer)
+    }
+    const timer = setTimeout(() => stopTyping(t.user_id), typingTimeout)
+    typingUsers.set(t.user_id, { name: t.name, timer })
+    renderTyping()
+  }
+
+  function stopTyping(userId){
+    const prev = typingUsers.get(userId)
+    if (!prev) {
+      return
+    }
+    clearTimeout(prev.timer)
+    typingUsers.delete(userId)
+    renderTyping()
+  }
+
+  let lastTypingSent = 0;
+  messageInput.addEventListener("input", () => {
+    const now = Date.now()
+    if (messageInput.value === "" || now - lastTypingSent < typingInterval) {
+      return
+    }
+    lastTypingSent = now
+    try {
+      sendFrame("typing", {})
+    } catch (err) {
+      // typing notifications are best effort
+    }
+  })
+
+  // presence: tell the server when this page is hidden and keep the status
+  // dots of other users up to date.
+  const statusClasses = { online: "bg-foam", away: "bg-gold", offline: "bg-muted" };
+
+  function sendStatus(){
+    try {
+      sendFrame("presence", { status: document.hidden ? "away" : "online" })
+    } catch (err) {
+      // the status is sent again once the connection is open
+    }
+  }
+
+  function updatePresence(p){
+    for (const dot of document.querySelectorAll(`[data-presence="${CSS.escape(p.user_id)}"]`)) {
+      dot.classList.remove(...Object.values(statusClasses))
+      dot.classList.add(statusClasses[p.status] || statusClasses.offline)
+    }
+  }
+
+  document.addEventListener("visibilitychange", () => {
+    sendStatus()
+    ackLatest()
+  })
+
+  // read receipts: acknowledge the newest message from the other user once it
+  // is actually visible, and show which of our messages they have seen.
+  let lastAcked = "";
+
+  function ackLatest(){
+    if (!messagesPath || document.hidden) {
+      return
+    }
+    const received = messageLog.querySelectorAll(`[data-id]:not([data-from="${CSS.escape(userID)}"])`)
+    const latest = received[received.length - 1]
+    if (!latest || latest.dataset.id === lastAcked) {
+      return
+    }
+    try {
+      sendFrame("ack", { message_id: latest.dataset.id })
+      lastAcked = latest.dataset.id
+    } catch (err) {
+      // acked again once the connection is open
+    }
+  }
+
+  function markSeen(receipt){
+    if (receipt.reader_id === userID) {
+      return
+    }
+    const el = findMessage(receipt.message_id)
+    if (!el) {
+      return
+    }
+    messageLog.querySelector(".msg-seen")?.remove()
+    const seen = document.createElement("span")
+    seen.className = "msg-seen text-muted text-sm block"
+    seen.innerText = "seen"
+    el.querySelector(".flex-1").append(seen)
+  }
+
+  // infinite scroll: when the log is scrolled to the top, load the page of
+  // messages before the oldest one currently rendered.
+  const historyPath = root.dataset.history;
+  let loadingHistory = false;
+  let hasMoreHistory = true;
+
+  async function loadOlder(){
+    if (!historyPath || loadingHistory || !hasMoreHistory) {
+      return
+    }
+    const oldest = messageLog.querySelector("[data-id]")
+    if (!oldest) {
+      hasMoreHistory = false
+      return
+    }
+    loadingHistory = true
+    try {
+      const params = new URLSearchParams({ before: oldest.dataset.id, format: "html" })
+      const resp = await fetch(`${historyPath}?${params}`)
+      if (resp.status !== 200) {
+        throw new Error(`Unexpected HTTP Status ${resp.status} ${resp.statusText}`)
+      }
+      hasMoreHistory = resp.headers.get("X-Has-More") === "true"
+      const html = await resp.text()
+      // keep the visible messages in place while prepending above them
+      const prevHeight = messageLog.scrollHeight
+      messageLog.insertAdjacentHTML("afterbegin", html)
+      messageLog.scrollTop += messageLog.scrollHeight - prevHeight
+    } catch (err) {
+      console.error(`loading history failed: ${err.message}`)
+    } finally {
+      loadingHistory = false
+    }
+  }
+
+  messageLog.addEventListener("scroll", () => {
+    if (messageLog.scrollTop < 50) {
+      loadOlder()
+    }
+  })
+
   function scrollToBottom(){
     messageLog.scrollTop = messageLog.scrollHeight;
   }
-  window.onload = scrollToBottom
+  // pages opened on a specific message (e.g. from search) scroll to it
+  // instead of the bottom
+  window.onload = () => {
+    const focus = root.dataset.focus && findMessage(root.dataset.focus)
+    if (!focus) {
+      scrollToBottom()
+      return
+    }
+    focus.classList.add("bg-highlight-med")
+    focus.scrollIntoView({ block: "center" })
+  }
   // appendLog appends the passed text to messageLog.
   function appendLog(msg, error) {
     const m = createMessage(msg)
@@ -88,36 +409,63 @@
     return m;
   }
 
+  // randomUUID is only available in secure contexts
+  function frameId(){
+    if (crypto.randomUUID) {
+      return crypto.randomUUID()
+    }
+    return `${Date.now()}-${Math.random().toString(16).slice(2)}`
+  }
+
+  function sendFrame(type, payload){
+    if (!conn || conn.readyState !== WebSocket.OPEN) {
+      throw new Error("not connected")
+    }
+    const id = frameId()
+    conn.send(JSON.stringify({
+      type,
+      version: protocolVersion,
+      id,
+      payload,
+    }))
+    return id
+  }
+
+  // sent message bodies by frame id, kept for a while so a message the
+  // server rejects (rate limits for example) can be put back in the input.
+  const pendingSends = new Map()
+
+  function restoreRejected(payload) {
+    const body = pendingSends.get(payload.ref)
+    if (body === undefined) {
+      return
+    }
+    pendingSends.delete(payload.ref)
+    if (messageInput.value === "") {
+      messageInput.value = body
+    }
+    if (payload.retry_after) {
+      console.warn(`message rejected, retry in ${Math.ceil(payload.retry_after / 1000)}s`)
+    }
+  }
+
   // onsubmit publishes the message from the user when the form is submitted.
-  publishForm.onsubmit = async (ev) => {
+  publishForm.onsubmit = (ev) => {
     ev.preventDefault();
 
     const msg = messageInput.value;
     if (msg === "") {
       return;
     }
-    messageInput.value = "";
 
-    expectingMessage = true;
-    const formData = new FormData();
-    const csrfToken = document.querySelector("[name=csrf_token]").value;
-    formData.append("message", msg);
-    formData.append("csrf_token", csrfToken);
-    formData.append("senderId", window.location.pathname.split("/")[2]);
-    formData.append("receiverId", window.location.pathname.split("/")[2]);
-    formData.append("timezone", timeZone);
     try {
-      const resp = await fetch("/publish", {
-        method: "POST",
-        body: formData,
-      });
-      if (resp.status !== 202) {
-        throw new Error(
-          `Unexpected HTTP Status ${resp.status} ${resp.statusText}`,
-        );
-      }
+      const id = sendFrame("send", { body: msg });
+      pendingSends.set(id, msg);
+      setTimeout(() => pendingSends.delete(id), 10000);
+      messageInput.value = "";
+      lastTypingSent = 0;
     } catch (err) {
-      appendLog(`Publish failed: ${err.message}`, true);
+      console.error(`Publish failed: ${err.message}`);
     }
   };
 })();